@@ -0,0 +1,147 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/lifecycle"
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+	"github.com/Azure/kubernetes-kms/pkg/proxy"
+	"github.com/Azure/kubernetes-kms/pkg/utils"
+	"github.com/Azure/kubernetes-kms/pkg/version"
+
+	"k8s.io/klog/v2"
+	"monis.app/mlog"
+)
+
+var (
+	listenAddr        = flag.String("listen-addr", ":7788", "Address the proxy listens on")
+	aadUpstream       = flag.String("aad-upstream", "https://login.microsoftonline.com/", "Base URL that AzureActiveDirectory requests are forwarded to")
+	keyvaultUpstream  = flag.String("keyvault-upstream", "", "Base URL that KeyVault requests are forwarded to. Defaults to https://<vault host> taken from the request path")
+	allowedVaultHosts = flag.String("allowed-vault-hosts", "", "Comma separated list of vault hosts requests can be forwarded to. Entries starting with *. match any subdomain, e.g. *.vault.azure.net")
+	tlsCertFile       = flag.String("tls-cert-file", "", "Path to the server certificate. If empty, the proxy serves plain HTTP")
+	tlsKeyFile        = flag.String("tls-key-file", "", "Path to the server key")
+	clientCAFile      = flag.String("client-ca-file", "", "Path to the CA bundle used to verify client certificates. If set, clients must present a certificate for mTLS")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests to complete on shutdown")
+	shutdownDelay     = flag.Duration("shutdown-delay", 0, "Time to wait on shutdown before requests are drained, e.g. until the proxy is removed from load balancers")
+	metricsBackend    = flag.String("metrics-backend", "prometheus", "Backend used for metrics")
+	metricsAddress    = flag.String("metrics-addr", "8096", "The address the metric endpoint binds to")
+	logFormatJSON     = flag.Bool("log-format-json", false, "set log formatter to json")
+	logLevel          = flag.Uint("v", 0, "In order of increasing verbosity: 0=warning/error, 2=info, 4=debug, 6=trace, 10=all")
+	versionInfo       = flag.Bool("version", false, "Prints the version information")
+)
+
+func main() {
+	if err := runProxy(); err != nil {
+		mlog.Fatal(err)
+	}
+}
+
+func runProxy() error {
+	defer mlog.Setup()() // set up log flushing and attempt to flush on exit
+	flag.Parse()
+	ctx := withShutdownSignal(context.Background())
+
+	logFormat := mlog.FormatText
+	if *logFormatJSON {
+		logFormat = mlog.FormatJSON
+	}
+
+	if *logLevel > math.MaxUint8 {
+		return fmt.Errorf("invalid log level: %d", *logLevel)
+	}
+
+	if err := mlog.ValidateAndSetKlogLevelAndFormatGlobally(ctx, klog.Level(uint8(*logLevel)), logFormat); err != nil {
+		return fmt.Errorf("invalid --log-level set: %w", err)
+	}
+
+	if *versionInfo {
+		if err := version.PrintVersion(); err != nil {
+			return fmt.Errorf("failed to print version: %w", err)
+		}
+		return nil
+	}
+
+	// the otlp backend is only configurable on the plugin
+	metricsServer, metricsCloser, err := metrics.InitMetricsExporter(*metricsBackend, *metricsAddress, metrics.OTLPConfig{})
+	if err != nil {
+		return fmt.Errorf("failed to initialize metrics exporter: %w", err)
+	}
+
+	mlog.Always("Starting proxy", "version", version.BuildVersion, "buildDate", version.BuildDate)
+
+	var hosts []string
+	for _, host := range strings.Split(*allowedVaultHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	p, err := proxy.New(proxy.Config{
+		AADUpstream:       *aadUpstream,
+		KeyVaultUpstream:  *keyvaultUpstream,
+		AllowedVaultHosts: hosts,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create proxy: %w", err)
+	}
+
+	server := &http.Server{
+		Addr:              *listenAddr,
+		Handler:           p,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	if *tlsCertFile != "" || *tlsKeyFile != "" || *clientCAFile != "" {
+		server.TLSConfig, err = utils.NewServerTLSConfig(*tlsCertFile, *tlsKeyFile, *clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to create tls config: %w", err)
+		}
+	}
+
+	manager := lifecycle.NewManager(lifecycle.ShutdownOptions{
+		Delay:       *shutdownDelay,
+		HTTPTimeout: *shutdownTimeout,
+	})
+	if err := manager.AddHTTPServer("proxy", server); err != nil {
+		return err
+	}
+	if metricsServer != nil {
+		if err := manager.AddHTTPServer("metrics", metricsServer); err != nil {
+			return err
+		}
+	}
+	manager.AddCloser(metricsCloser)
+
+	mlog.Always("Listening for connections", "addr", *listenAddr, "tls", server.TLSConfig != nil)
+	return manager.Run(ctx)
+}
+
+// withShutdownSignal returns a copy of the parent context that will close if
+// the process receives termination signals.
+func withShutdownSignal(ctx context.Context) context.Context {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
+
+	nctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		<-signalChan
+		mlog.Always("received shutdown signal")
+		cancel()
+	}()
+	return nctx
+}
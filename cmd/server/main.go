@@ -7,52 +7,132 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Azure/kubernetes-kms/pkg/auth"
 	"github.com/Azure/kubernetes-kms/pkg/config"
+	"github.com/Azure/kubernetes-kms/pkg/lifecycle"
 	"github.com/Azure/kubernetes-kms/pkg/metrics"
 	"github.com/Azure/kubernetes-kms/pkg/plugin"
 	"github.com/Azure/kubernetes-kms/pkg/utils"
 	"github.com/Azure/kubernetes-kms/pkg/version"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 	"k8s.io/klog/v2"
 	kmsv1 "k8s.io/kms/apis/v1beta1"
 	kmsv2 "k8s.io/kms/apis/v2"
 	"monis.app/mlog"
 )
 
+// readyNotifyInterval is the time between two Key Vault checks before systemd is told the plugin is ready.
+const readyNotifyInterval = 5 * time.Second
+
 var (
-	listenAddr    = flag.String("listen-addr", "unix:///opt/azurekms.socket", "gRPC listen address")
+	listenAddr    = flag.String("listen-addr", "unix:///opt/azurekms.socket", "gRPC listen address, unix://<path>, unix://@<name> for an abstract socket, tcp://<host>:<port>, or systemd://[<name>] for a socket passed by systemd. tcp requires mTLS")
+	socketMode    = flag.String("socket-mode", "", "Permission of the unix socket file, in octal, e.g. 0600. Defaults to the permission given by the process umask")
+	socketUID     = flag.Int("socket-uid", -1, "Owner uid of the unix socket file. -1 keeps the uid of the plugin")
+	socketGID     = flag.Int("socket-gid", -1, "Owner gid of the unix socket file. -1 keeps the gid of the plugin")
 	keyvaultName  = flag.String("keyvault-name", "", "Azure Key Vault name")
 	keyName       = flag.String("key-name", "", "Azure Key Vault KMS key name")
 	keyVersion    = flag.String("key-version", "", "Azure Key Vault KMS key version")
+	vaultURL      = flag.String("vault-url", "", "Azure Key Vault URL, e.g. https://myvault.vault.azure.net/. Mutually exclusive with --keyvault-name")
+	keyID         = flag.String("key-id", "", "Azure Key Vault KMS key identifier in the form https://<host>/keys/<name>/<version>. Mutually exclusive with --keyvault-name, --vault-url, --key-name and --key-version")
 	managedHSM    = flag.Bool("managed-hsm", false, "Azure Key Vault Managed HSM. Refer to https://docs.microsoft.com/en-us/azure/key-vault/managed-hsm/overview for more details.")
 	logFormatJSON = flag.Bool("log-format-json", false, "set log formatter to json")
 	logLevel      = flag.Uint("v", 0, "In order of increasing verbosity: 0=warning/error, 2=info, 4=debug, 6=trace, 10=all")
 	// TODO remove this flag in future release.
 	_              = flag.String("configFilePath", "/etc/kubernetes/azure.json", "[DEPRECATED] Path for Azure Cloud Provider config file")
-	configFilePath = flag.String("config-file-path", "/etc/kubernetes/azure.json", "Path for Azure Cloud Provider config file")
+	configFilePath = flag.String("config-file-path", "/etc/kubernetes/azure.json", "Path for Azure Cloud Provider config file. If empty, the config is loaded from AZURE_* environment variables only")
 	versionInfo    = flag.Bool("version", false, "Prints the version information")
 
 	healthzPort    = flag.Uint("healthz-port", 8787, "port for health check")
 	healthzPath    = flag.String("healthz-path", "/healthz", "path for health check")
 	healthzTimeout = flag.Duration("healthz-timeout", 20*time.Second, "RPC timeout for health check")
-	metricsBackend = flag.String("metrics-backend", "prometheus", "Backend used for metrics")
+	metricsBackend = flag.String("metrics-backend", "prometheus", "Comma separated list of backends used for metrics: prometheus, otlp")
 	metricsAddress = flag.String("metrics-addr", "8095", "The address the metric endpoint binds to")
 
+	livezPath              = flag.String("livez-path", "/livez", "path for the liveness check, which only checks that the plugin responds on its socket. Empty disables it")
+	readyzPath             = flag.String("readyz-path", "/readyz", "path for the readiness check, which also checks Key Vault. Empty disables it")
+	readyzCacheTTL         = flag.Duration("readyz-cache-ttl", 30*time.Second, "Time the result of the Key Vault check of the readiness check is reused")
+	readyzFailureThreshold = flag.Int("readyz-failure-threshold", 3, "Number of Key Vault checks in a row that must fail before the readiness check fails")
+
+	auditLogExcludeProbes = flag.Bool("audit-log-exclude-probes", false, "Do not log the encrypt and decrypt requests of health checks, so only the requests of kube-apiserver are logged")
+
+	healthzCheckKeyAttributes = flag.Bool("healthz-check-key-attributes", false, "Check in the health check that the key is enabled and not expired. Requires the get key permission")
+
 	proxyMode    = flag.Bool("proxy-mode", false, "Proxy mode")
 	proxyAddress = flag.String("proxy-address", "", "proxy address")
 	proxyPort    = flag.Int("proxy-port", 7788, "port for proxy")
+
+	proxyTLS            = flag.Bool("proxy-tls", false, "Use TLS to connect to the proxy in proxy mode")
+	proxyCAFile         = flag.String("proxy-ca-file", "", "Path to the CA bundle used to verify the proxy server certificate. Defaults to the system roots")
+	proxyClientCertFile = flag.String("proxy-client-cert-file", "", "Path to the client certificate presented to the proxy for mTLS")
+	proxyClientKeyFile  = flag.String("proxy-client-key-file", "", "Path to the client key presented to the proxy for mTLS")
+	proxyServerName     = flag.String("proxy-server-name", "", "Server name to verify in the proxy server certificate. Defaults to the proxy address")
+
+	httpsProxy                = flag.String("https-proxy", "", "URL of the forward proxy used to reach Key Vault and AAD. Defaults to the HTTPS_PROXY environment variable")
+	noProxy                   = flag.String("no-proxy", "", "Comma separated list of hosts, domains and CIDRs that bypass the forward proxy. Defaults to the NO_PROXY environment variable")
+	httpsProxyCredentialsFile = flag.String("https-proxy-credentials-file", "", "Path to a file with the forward proxy basic auth credentials in the form username:password")
+
+	tlsCertFile              = flag.String("tls-cert-file", "", "Path to the gRPC server certificate. Required when --listen-addr is tcp://")
+	tlsKeyFile               = flag.String("tls-key-file", "", "Path to the gRPC server key. Required when --listen-addr is tcp://")
+	tlsClientCAFile          = flag.String("tls-client-ca-file", "", "Path to the CA bundle used to verify client certificates. Required when --listen-addr is tcp://")
+	tlsAllowedClientSubjects = flag.String("tls-allowed-client-subjects", "", "Comma separated list of client certificate common names or DNS names allowed to connect. Defaults to any client signed by --tls-client-ca-file")
+
+	healthzTLSCAFile         = flag.String("healthz-tls-ca-file", "", "Path to the CA bundle used by the health check to verify the gRPC server certificate when listening on tcp. Defaults to the system roots")
+	healthzTLSClientCertFile = flag.String("healthz-tls-client-cert-file", "", "Path to the client certificate presented by the health check. Required when listening on tcp")
+	healthzTLSClientKeyFile  = flag.String("healthz-tls-client-key-file", "", "Path to the client key presented by the health check. Required when listening on tcp")
+	healthzTLSServerName     = flag.String("healthz-tls-server-name", "localhost", "Server name verified by the health check in the gRPC server certificate when listening on tcp")
+
+	allowedPeerUIDs        = flag.String("allowed-peer-uids", "", "Comma separated list of uids allowed to call the plugin on the unix socket. If no peer allowlist is set, any process that can connect is allowed")
+	allowedPeerGIDs        = flag.String("allowed-peer-gids", "", "Comma separated list of gids allowed to call the plugin on the unix socket")
+	allowedPeerExecutables = flag.String("allowed-peer-executables", "", "Comma separated list of executable paths allowed to call the plugin on the unix socket")
+
+	grpcHealthCheckInterval = flag.Duration("grpc-health-check-interval", time.Minute, "Interval between the checks that set the status of the grpc.health.v1 service from the latest kms v2 status probe, or from a Key Vault round trip without status prober. 0 disables the checks and the services are always SERVING")
+	shutdownTimeout         = flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for in-flight gRPC requests to complete on shutdown")
+	shutdownDelay           = flag.Duration("shutdown-delay", 0, "Time to wait on shutdown after the health checks fail and before requests are drained, so probes observe the failing readiness checks. Set it to at least the readiness probe period")
+	httpShutdownTimeout     = flag.Duration("http-shutdown-timeout", 5*time.Second, "Time to wait for in-flight health check and metrics requests to complete on shutdown")
+	grpcReflection          = flag.Bool("grpc-reflection", false, "Register the gRPC server reflection service on the listen address")
+
+	grpcMaxRecvMsgSize               = flag.Int("grpc-max-recv-msg-size", 4*1024*1024, "Maximum size in bytes of a gRPC message the server can receive")
+	grpcMaxSendMsgSize               = flag.Int("grpc-max-send-msg-size", math.MaxInt32, "Maximum size in bytes of a gRPC message the server can send")
+	grpcMaxConcurrentStreams         = flag.Uint("grpc-max-concurrent-streams", 0, "Maximum number of concurrent gRPC streams per connection. 0 means no limit")
+	grpcKeepaliveMinTime             = flag.Duration("grpc-keepalive-min-time", 5*time.Minute, "Minimum time clients must wait between keepalive pings. Clients that ping more often are disconnected")
+	grpcKeepalivePermitWithoutStream = flag.Bool("grpc-keepalive-permit-without-stream", false, "Allow clients to send keepalive pings when there are no active gRPC streams")
+	grpcConnectionTimeout            = flag.Duration("grpc-connection-timeout", 120*time.Second, "Timeout for new gRPC connections to complete setup, including the TLS handshake")
+
+	enableKMSv1              = flag.Bool("enable-kms-v1", true, "Serve the deprecated KMS v1 API. Disable it once no data encrypted with KMS v1 is read anymore")
+	enableKMSv2              = flag.Bool("enable-kms-v2", true, "Serve the KMS v2 API")
+	kmsV1UsageReportInterval = flag.Duration("kms-v1-usage-report-interval", time.Hour, "Interval between the log summaries of KMS v1 decrypt requests. 0 disables the summary")
+
+	kmsV2StatusProbeInterval = flag.Duration("kms-v2-status-probe-interval", 30*time.Second, "Interval between the Key Vault probes that KMS v2 Status is served from. 0 probes Key Vault on every Status call")
+	kmsV2StatusMaxStaleness  = flag.Duration("kms-v2-status-max-staleness", 2*time.Minute, "Maximum age of the probe that KMS v2 Status is served from. An older probe is replaced by probing Key Vault on the Status call")
+
+	otlpProtocol       = flag.String("otlp-protocol", metrics.OTLPProtocolGRPC, "Protocol of the otlp metrics backend: grpc or http")
+	otlpEndpoint       = flag.String("otlp-endpoint", "", "host:port of the OTLP receiver of the otlp metrics backend, e.g. an OpenTelemetry Collector. Defaults to localhost:4317 for grpc and localhost:4318 for http")
+	otlpHeaders        = flag.String("otlp-headers", "", "Comma separated list of key=value headers sent with every OTLP export")
+	otlpHeadersFile    = flag.String("otlp-headers-file", "", "Path to a file with the key=value headers sent with every OTLP export, one per line, e.g. for auth tokens that must not be visible on the command line. Overrides the same headers of --otlp-headers")
+	otlpInsecure       = flag.Bool("otlp-insecure", false, "Export metrics to the OTLP receiver without TLS. Defaults to true for a loopback endpoint if none of --otlp-ca-file, --otlp-client-cert-file and --otlp-client-key-file is set. Cannot be used with these files")
+	otlpCAFile         = flag.String("otlp-ca-file", "", "Path to the CA bundle used to verify the OTLP receiver certificate. Defaults to the system roots")
+	otlpClientCertFile = flag.String("otlp-client-cert-file", "", "Path to the client certificate presented to the OTLP receiver")
+	otlpClientKeyFile  = flag.String("otlp-client-key-file", "", "Path to the client key presented to the OTLP receiver")
+	otlpExportInterval = flag.Duration("otlp-export-interval", time.Minute, "Interval between two exports of the otlp metrics backend")
+
+	providersConfigFile = flag.String("providers-config-file", "", "Path to a config file listing multiple KMS providers, each with its own listen address, key, identity and health check path. Mutually exclusive with --listen-addr, --keyvault-name, --vault-url, --key-name, --key-version, --key-id, --managed-hsm and --healthz-path")
 )
 
 func main() {
@@ -87,28 +167,295 @@ func setupKMSPlugin() error {
 	}
 
 	// initialize metrics exporter
-	err := metrics.InitMetricsExporter(*metricsBackend, *metricsAddress)
+	otlpConfig, err := getOTLPConfig()
+	if err != nil {
+		return err
+	}
+	metricsServer, metricsCloser, err := metrics.InitMetricsExporter(*metricsBackend, *metricsAddress, otlpConfig)
 	if err != nil {
 		return fmt.Errorf("failed to initialize metrics exporter: %w", err)
 	}
 
+	manager := lifecycle.NewManager(lifecycle.ShutdownOptions{
+		Delay:       *shutdownDelay,
+		GRPCTimeout: *shutdownTimeout,
+		HTTPTimeout: *httpShutdownTimeout,
+	})
+	if metricsServer != nil {
+		if err := manager.AddHTTPServer("metrics", metricsServer); err != nil {
+			return err
+		}
+	}
+	// export the metrics of the shutdown before the process exits
+	manager.AddCloser(metricsCloser)
+	// tell systemd before readiness fails and requests are drained
+	manager.OnShutdown(func() {
+		if _, err := utils.SdNotify(utils.SdNotifyStopping); err != nil {
+			mlog.Error("failed to notify systemd", err)
+		}
+	})
+
 	mlog.Always("Starting KeyManagementServiceServer service", "version", version.BuildVersion, "buildDate", version.BuildDate)
 
 	pluginConfig := &plugin.Config{
 		KeyVaultName:   *keyvaultName,
 		KeyName:        *keyName,
 		KeyVersion:     *keyVersion,
+		VaultURL:       *vaultURL,
+		KeyID:          *keyID,
 		ManagedHSM:     *managedHSM,
 		ProxyMode:      *proxyMode,
 		ProxyAddress:   *proxyAddress,
 		ProxyPort:      *proxyPort,
 		ConfigFilePath: *configFilePath,
+		SocketUID:      *socketUID,
+		SocketGID:      *socketGID,
+
+		ProxyTLS:            *proxyTLS,
+		ProxyCAFile:         *proxyCAFile,
+		ProxyClientCertFile: *proxyClientCertFile,
+		ProxyClientKeyFile:  *proxyClientKeyFile,
+		ProxyServerName:     *proxyServerName,
+
+		HTTPSProxy:                *httpsProxy,
+		NoProxy:                   *noProxy,
+		HTTPSProxyCredentialsFile: *httpsProxyCredentialsFile,
+
+		TLSCertFile:              *tlsCertFile,
+		TLSKeyFile:               *tlsKeyFile,
+		TLSClientCAFile:          *tlsClientCAFile,
+		TLSAllowedClientSubjects: splitList(*tlsAllowedClientSubjects),
+
+		HealthzTLSCAFile:         *healthzTLSCAFile,
+		HealthzTLSClientCertFile: *healthzTLSClientCertFile,
+		HealthzTLSClientKeyFile:  *healthzTLSClientKeyFile,
+		HealthzTLSServerName:     *healthzTLSServerName,
+	}
+
+	if pluginConfig.AllowedPeers.UIDs, err = parseIDList(*allowedPeerUIDs); err != nil {
+		return fmt.Errorf("invalid --allowed-peer-uids: %w", err)
+	}
+	if pluginConfig.AllowedPeers.GIDs, err = parseIDList(*allowedPeerGIDs); err != nil {
+		return fmt.Errorf("invalid --allowed-peer-gids: %w", err)
+	}
+	pluginConfig.AllowedPeers.Executables = splitList(*allowedPeerExecutables)
+
+	if *socketMode != "" {
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0o777 {
+			return fmt.Errorf("invalid --socket-mode %q, must be an octal permission such as 0600", *socketMode)
+		}
+		pluginConfig.SocketMode = os.FileMode(mode)
+	}
+
+	if *grpcMaxRecvMsgSize <= 0 {
+		return fmt.Errorf("invalid --grpc-max-recv-msg-size %d, must be greater than 0", *grpcMaxRecvMsgSize)
+	}
+	if *grpcMaxSendMsgSize <= 0 {
+		return fmt.Errorf("invalid --grpc-max-send-msg-size %d, must be greater than 0", *grpcMaxSendMsgSize)
+	}
+	if *grpcMaxConcurrentStreams > math.MaxUint32 {
+		return fmt.Errorf("invalid --grpc-max-concurrent-streams %d", *grpcMaxConcurrentStreams)
+	}
+	if *grpcConnectionTimeout <= 0 {
+		return fmt.Errorf("invalid --grpc-connection-timeout %s, must be greater than 0", *grpcConnectionTimeout)
+	}
+	pluginConfig.GRPCLimits = utils.GRPCServerLimits{
+		MaxRecvMsgSize:               *grpcMaxRecvMsgSize,
+		MaxSendMsgSize:               *grpcMaxSendMsgSize,
+		MaxConcurrentStreams:         uint32(*grpcMaxConcurrentStreams),
+		KeepaliveMinTime:             *grpcKeepaliveMinTime,
+		KeepalivePermitWithoutStream: *grpcKeepalivePermitWithoutStream,
+		ConnectionTimeout:            *grpcConnectionTimeout,
+	}
+
+	if !*enableKMSv1 && !*enableKMSv2 {
+		return fmt.Errorf("at least one of --enable-kms-v1 and --enable-kms-v2 must be set")
+	}
+	if *kmsV1UsageReportInterval < 0 {
+		return fmt.Errorf("invalid --kms-v1-usage-report-interval %s, must not be negative", *kmsV1UsageReportInterval)
+	}
+	pluginConfig.EnableKMSv1 = *enableKMSv1
+	pluginConfig.EnableKMSv2 = *enableKMSv2
+
+	if *kmsV2StatusProbeInterval < 0 {
+		return fmt.Errorf("invalid --kms-v2-status-probe-interval %s, must not be negative", *kmsV2StatusProbeInterval)
+	}
+	if *kmsV2StatusProbeInterval > 0 && *kmsV2StatusMaxStaleness < *kmsV2StatusProbeInterval {
+		return fmt.Errorf("invalid --kms-v2-status-max-staleness %s, must not be less than --kms-v2-status-probe-interval %s",
+			*kmsV2StatusMaxStaleness, *kmsV2StatusProbeInterval)
+	}
+
+	if *grpcHealthCheckInterval < 0 {
+		return fmt.Errorf("invalid --grpc-health-check-interval %s, must not be negative", *grpcHealthCheckInterval)
+	}
+
+	var proxyTLSConfig *tls.Config
+	if pluginConfig.ProxyMode && pluginConfig.ProxyTLS {
+		proxyTLSConfig, err = utils.NewClientTLSConfig(
+			pluginConfig.ProxyCAFile,
+			pluginConfig.ProxyClientCertFile,
+			pluginConfig.ProxyClientKeyFile,
+			pluginConfig.ProxyServerName,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create proxy tls config: %w", err)
+		}
+	}
+
+	var httpProxy *utils.HTTPProxyConfig
+	if pluginConfig.HTTPSProxy != "" || pluginConfig.NoProxy != "" || pluginConfig.HTTPSProxyCredentialsFile != "" {
+		if pluginConfig.ProxyMode {
+			return fmt.Errorf("--https-proxy, --no-proxy and --https-proxy-credentials-file cannot be used with --proxy-mode")
+		}
+		httpProxy = &utils.HTTPProxyConfig{
+			HTTPSProxy:      pluginConfig.HTTPSProxy,
+			NoProxy:         pluginConfig.NoProxy,
+			CredentialsFile: pluginConfig.HTTPSProxyCredentialsFile,
+		}
+	}
+
+	for _, path := range []string{*livezPath, *readyzPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid --livez-path or --readyz-path %q, must start with /", path)
+		}
+	}
+	if *livezPath != "" && *livezPath == *readyzPath {
+		return fmt.Errorf("--livez-path and --readyz-path must be different")
+	}
+	providers, err := getProviders(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	if *readyzFailureThreshold < 1 {
+		return fmt.Errorf("invalid --readyz-failure-threshold %d, must be at least 1", *readyzFailureThreshold)
+	}
+
+	var healthzs []*plugin.HealthZ
+	sockets := &systemdSockets{}
+	for _, p := range providers {
+		healthz, err := startProvider(ctx, manager, p, sockets, proxyTLSConfig, httpProxy)
+		if err != nil {
+			if p.name != "" {
+				return fmt.Errorf("failed to start provider %s: %w", p.name, err)
+			}
+			return err
+		}
+		manager.OnShutdown(healthz.Shutdown)
+		healthzs = append(healthzs, healthz)
+	}
+	sockets.closeUnused()
+
+	// Health check for kms v1 and v2 of every provider, and the liveness and readiness checks of all providers
+	if err := manager.AddHTTPServer("healthz", plugin.NewHealthZServer(*livezPath, *readyzPath, healthzs...)); err != nil {
+		return err
+	}
+
+	// systemd is told the plugin is ready once every provider encrypted and decrypted with Key Vault,
+	// not only when the listeners are bound
+	go func() {
+		if !plugin.WaitReady(ctx, readyNotifyInterval, healthzs...) {
+			return
+		}
+		if _, err := utils.SdNotify(utils.SdNotifyReady); err != nil {
+			mlog.Error("failed to notify systemd", err)
+		}
+	}()
+
+	return manager.Run(ctx)
+}
+
+// kmsProvider is a KMS provider hosted by the plugin, with its own listen address, key and identity.
+// The name is empty when the provider is configured by the command line flags only.
+type kmsProvider struct {
+	name        string
+	listenAddr  string
+	healthzPath string
+	config      plugin.Config
+}
+
+// getProviders returns the providers listed in --providers-config-file, or a single provider
+// configured by the command line flags. Settings that are not set in the file fall back to baseConfig.
+func getProviders(baseConfig *plugin.Config) ([]kmsProvider, error) {
+	if *providersConfigFile == "" {
+		if err := config.ValidateHealthzPath(*healthzPath, *livezPath, *readyzPath); err != nil {
+			return nil, fmt.Errorf("invalid --healthz-path: %w", err)
+		}
+		return []kmsProvider{{
+			listenAddr:  *listenAddr,
+			healthzPath: *healthzPath,
+			config:      *baseConfig,
+		}}, nil
+	}
+
+	var conflicts []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen-addr", "keyvault-name", "vault-url", "key-name", "key-version", "key-id", "managed-hsm", "healthz-path":
+			conflicts = append(conflicts, "--"+f.Name)
+		}
+	})
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%s cannot be used with --providers-config-file", strings.Join(conflicts, ", "))
+	}
+
+	providersConfig, err := config.GetProvidersConfig(*providersConfigFile, *livezPath, *readyzPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get providers config: %w", err)
+	}
+
+	var providers []kmsProvider
+	for _, p := range providersConfig.Providers {
+		cfg := *baseConfig
+		cfg.KeyVaultName = p.KeyVaultName
+		cfg.VaultURL = p.VaultURL
+		cfg.KeyName = p.KeyName
+		cfg.KeyVersion = p.KeyVersion
+		cfg.KeyID = p.KeyID
+		cfg.ManagedHSM = p.ManagedHSM
+		if p.ConfigFilePath != "" {
+			cfg.ConfigFilePath = p.ConfigFilePath
+		}
+		providers = append(providers, kmsProvider{
+			name:        p.Name,
+			listenAddr:  p.ListenAddr,
+			healthzPath: p.HealthzPath,
+			config:      cfg,
+		})
+	}
+	return providers, nil
+}
+
+// startProvider creates the key vault client of the provider and registers the gRPC server for the
+// kms v1 and v2 servers and the grpc.health.v1 service on its listen address with the manager.
+// It returns the health check of the provider.
+func startProvider(
+	ctx context.Context,
+	manager *lifecycle.Manager,
+	p kmsProvider,
+	sockets *systemdSockets,
+	proxyTLSConfig *tls.Config,
+	httpProxy *utils.HTTPProxyConfig,
+) (*plugin.HealthZ, error) {
+	pluginConfig := &p.config
+
+	if pluginConfig.KeyID != "" {
+		if pluginConfig.KeyVaultName != "" || pluginConfig.VaultURL != "" || pluginConfig.KeyName != "" || pluginConfig.KeyVersion != "" {
+			return nil, fmt.Errorf("--key-id cannot be used with --keyvault-name, --vault-url, --key-name or --key-version")
+		}
+		var err error
+		pluginConfig.VaultURL, pluginConfig.KeyName, pluginConfig.KeyVersion, err = plugin.ParseKeyID(pluginConfig.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key id: %w", err)
+		}
 	}
 
 	azureConfig, err := config.GetAzureConfig(pluginConfig.ConfigFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to get azure config: %w", err)
+		return nil, fmt.Errorf("failed to get azure config: %w", err)
 	}
+	auth.LogAzureConfigSources(azureConfig)
 
 	kvClient, err := plugin.NewKeyVaultClient(
 		azureConfig,
@@ -119,71 +466,317 @@ func setupKMSPlugin() error {
 		pluginConfig.ProxyAddress,
 		pluginConfig.ProxyPort,
 		pluginConfig.ManagedHSM,
+		proxyTLSConfig,
+		httpProxy,
+		pluginConfig.VaultURL,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create key vault client: %w", err)
+		return nil, fmt.Errorf("failed to create key vault client: %w", err)
 	}
 
 	// Initialize and run the GRPC server
-	proto, addr, err := utils.ParseEndpoint(*listenAddr)
+	proto, addr, err := utils.ParseEndpoint(p.listenAddr)
 	if err != nil {
-		return fmt.Errorf("failed to parse endpoint: %w", err)
+		return nil, fmt.Errorf("failed to parse endpoint: %w", err)
 	}
-	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove socket file %s: %w", addr, err)
+	var listener net.Listener
+	lock := io.Closer(io.NopCloser(nil))
+	switch proto {
+	case "tcp":
+		listener, err = net.Listen(proto, addr)
+	case "systemd":
+		listener, err = sockets.listener(addr)
+	default:
+		listener, lock, err = utils.ListenUnix(addr, utils.UnixSocketOptions{
+			Mode: pluginConfig.SocketMode,
+			UID:  pluginConfig.SocketUID,
+			GID:  pluginConfig.SocketGID,
+		})
 	}
-
-	listener, err := net.Listen(proto, addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen addr: %s, proto: %s: %w", addr, proto, err)
+		return nil, fmt.Errorf("failed to listen addr: %s, proto: %s: %w", addr, proto, err)
 	}
+	// sockets passed by systemd can be tcp as well
+	isTCP := listener.Addr().Network() == "tcp"
+
+	opts := append(pluginConfig.GRPCLimits.ServerOptions(),
+		// peer authorization is first, so denied peers are not logged and counted as failed requests.
+		// The recovery interceptors are last, so a panic in a handler is reported as an error by the others
+		grpc.ChainUnaryInterceptor(
+			utils.PeerAuthorizationUnaryInterceptor,
+			utils.ProviderUnaryInterceptor(p.name),
+			plugin.OriginUnaryInterceptor,
+			utils.UnaryServerInterceptor,
+			utils.RecoveryUnaryInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			utils.PeerAuthorizationStreamInterceptor,
+			utils.ProviderStreamInterceptor(p.name),
+			utils.StreamServerInterceptor,
+			utils.RecoveryStreamInterceptor,
+		),
+	)
 
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(utils.UnaryServerInterceptor),
+	if !pluginConfig.AllowedPeers.IsEmpty() {
+		if isTCP {
+			lock.Close()
+			return nil, fmt.Errorf("--allowed-peer-uids, --allowed-peer-gids and --allowed-peer-executables require a unix socket")
+		}
+		peerCredentials, err := utils.NewPeerCredentials(pluginConfig.AllowedPeers, p.name)
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("failed to create peer credentials: %w", err)
+		}
+		opts = append(opts, grpc.Creds(peerCredentials))
+	}
+
+	var healthzTLSConfig *tls.Config
+	if isTCP {
+		// the server verifies client certificates, so the health check cannot connect without one
+		if pluginConfig.HealthzTLSClientCertFile == "" || pluginConfig.HealthzTLSClientKeyFile == "" {
+			lock.Close()
+			return nil, fmt.Errorf("--healthz-tls-client-cert-file and --healthz-tls-client-key-file are required when listening on tcp")
+		}
+		// the plugin can decrypt any DEK, so clients on the network must authenticate with mTLS
+		serverTLSConfig, err := utils.NewReloadingServerTLSConfig(
+			pluginConfig.TLSCertFile,
+			pluginConfig.TLSKeyFile,
+			pluginConfig.TLSClientCAFile,
+			pluginConfig.TLSAllowedClientSubjects,
+		)
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("failed to create server tls config: %w", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+
+		healthzTLSConfig, err = utils.NewClientTLSConfig(
+			pluginConfig.HealthzTLSCAFile,
+			pluginConfig.HealthzTLSClientCertFile,
+			pluginConfig.HealthzTLSClientKeyFile,
+			pluginConfig.HealthzTLSServerName,
+		)
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("failed to create health check tls config: %w", err)
+		}
 	}
 
 	s := grpc.NewServer(opts...)
 
 	// register kms v1 server
-	kmsV1Server, err := plugin.NewKMSv1Server(kvClient)
-	if err != nil {
-		return fmt.Errorf("failed to create server: %w", err)
+	var kmsV1Server *plugin.KeyManagementServiceServer
+	if pluginConfig.EnableKMSv1 {
+		kmsV1Server, err = plugin.NewKMSv1Server(kvClient)
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("failed to create server: %w", err)
+		}
+		kmsV1Server.ExcludeProbesFromAuditLog = *auditLogExcludeProbes
+		kmsv1.RegisterKeyManagementServiceServer(s, kmsV1Server)
+		if *kmsV1UsageReportInterval > 0 {
+			go kmsV1Server.LogV1DecryptUsage(ctx, *kmsV1UsageReportInterval, p.name)
+		}
 	}
-	kmsv1.RegisterKeyManagementServiceServer(s, kmsV1Server)
 
 	// register kms v2 server
-	kmsV2Server, err := plugin.NewKMSv2Server(kvClient)
-	if err != nil {
-		return fmt.Errorf("failed to create kms V2 server: %w", err)
+	var kmsV2Server *plugin.KeyManagementServiceV2Server
+	if pluginConfig.EnableKMSv2 {
+		kmsV2Server, err = plugin.NewKMSv2Server(kvClient)
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("failed to create kms V2 server: %w", err)
+		}
+		kmsV2Server.ExcludeProbesFromAuditLog = *auditLogExcludeProbes
+		kmsV2Server.StatusProbeTimeout = *healthzTimeout
+		if *kmsV2StatusProbeInterval > 0 {
+			kmsV2Server.StartStatusProber(metrics.WithProvider(ctx, p.name), *kmsV2StatusProbeInterval, *healthzTimeout, *kmsV2StatusMaxStaleness)
+		}
+		kmsv2.RegisterKeyManagementServiceServer(s, kmsV2Server)
 	}
-	kmsv2.RegisterKeyManagementServiceServer(s, kmsV2Server)
 
-	mlog.Always("Listening for connections", "addr", listener.Addr().String())
-	go func() {
-		if err := s.Serve(listener); err != nil {
-			mlog.Fatal(fmt.Errorf("failed to serve kms server: %w", err))
-		}
-	}()
+	// register grpc.health.v1, with the status driven by Key Vault checks
+	grpcHealth := &plugin.GRPCHealth{
+		KMSv1Server: kmsV1Server,
+		KMSv2Server: kmsV2Server,
+		Interval:    *grpcHealthCheckInterval,
+		RPCTimeout:  *healthzTimeout,
+		Provider:    p.name,
+	}
+	grpcHealth.Register(s)
+	manager.OnShutdown(grpcHealth.Shutdown)
+	go grpcHealth.Run(ctx)
+
+	if *grpcReflection {
+		reflection.Register(s)
+	}
+
+	mlog.Always("Listening for connections", "addr", listener.Addr().String(), "provider", p.name,
+		"kmsV1", pluginConfig.EnableKMSv1, "kmsV2", pluginConfig.EnableKMSv2)
+	serverName := "kms server"
+	if p.name != "" {
+		serverName += " " + p.name
+	}
+	manager.AddGRPCServer(serverName, s, listener)
+	// removes the unix socket once the server is stopped
+	manager.AddCloser(lock)
 
-	// Health check for kms v1 and v2
 	healthz := &plugin.HealthZ{
 		KMSv1Server: kmsV1Server,
 		KMSv2Server: kmsV2Server,
 		HealthCheckURL: &url.URL{
 			Host: net.JoinHostPort("", strconv.FormatUint(uint64(*healthzPort), 10)),
-			Path: *healthzPath,
+			Path: p.healthzPath,
 		},
-		UnixSocketPath: listener.Addr().String(),
-		RPCTimeout:     *healthzTimeout,
+		RPCTimeout:             *healthzTimeout,
+		Provider:               p.name,
+		ReadyzCacheTTL:         *readyzCacheTTL,
+		ReadyzFailureThreshold: *readyzFailureThreshold,
+		CheckKeyAttributes:     *healthzCheckKeyAttributes,
+	}
+	if isTCP {
+		healthz.TCPAddress = listener.Addr().String()
+		healthz.ClientTLSConfig = healthzTLSConfig
+	} else {
+		healthz.UnixSocketPath = listener.Addr().String()
 	}
-	go healthz.Serve()
 
-	<-ctx.Done()
-	// gracefully stop the grpc server
-	mlog.Always("terminating the server")
-	s.GracefulStop()
+	return healthz, nil
+}
 
-	return nil
+// systemdSockets hands out the listeners passed by systemd socket activation to the providers.
+// The listeners are only read once, since the LISTEN_* environment variables are unset afterwards.
+type systemdSockets struct {
+	listeners []utils.SystemdListener
+	used      []bool
+	loaded    bool
+}
+
+// listener returns the listener passed by systemd socket activation with the given name.
+// If name is empty, exactly one listener must be passed.
+func (s *systemdSockets) listener(name string) (net.Listener, error) {
+	if !s.loaded {
+		listeners, err := utils.SystemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		s.listeners, s.used, s.loaded = listeners, make([]bool, len(listeners)), true
+	}
+	if len(s.listeners) == 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd, LISTEN_FDS is not set")
+	}
+
+	for i, l := range s.listeners {
+		if !s.used[i] && (l.Name == name || (name == "" && len(s.listeners) == 1)) {
+			s.used[i] = true
+			return l.Listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
+
+// closeUnused closes the listeners that are not used by any provider.
+func (s *systemdSockets) closeUnused() {
+	for i, l := range s.listeners {
+		if !s.used[i] {
+			// unused sockets stay open in systemd
+			l.Listener.Close()
+		}
+	}
+}
+
+// getOTLPConfig returns the config of the otlp metrics backend from the flags.
+func getOTLPConfig() (metrics.OTLPConfig, error) {
+	config := metrics.OTLPConfig{
+		Protocol:       *otlpProtocol,
+		Endpoint:       *otlpEndpoint,
+		Insecure:       *otlpInsecure,
+		ExportInterval: *otlpExportInterval,
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = metrics.DefaultOTLPEndpoint(config.Protocol)
+	}
+	headers, err := parseHeaders(*otlpHeaders)
+	if err != nil {
+		return config, fmt.Errorf("invalid --otlp-headers: %w", err)
+	}
+	if *otlpHeadersFile != "" {
+		content, err := os.ReadFile(*otlpHeadersFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to read --otlp-headers-file: %w", err)
+		}
+		fileHeaders, err := parseHeaders(strings.ReplaceAll(string(content), "\n", ","))
+		if err != nil {
+			return config, fmt.Errorf("invalid --otlp-headers-file: %w", err)
+		}
+		for key, value := range fileHeaders {
+			headers[key] = value
+		}
+	}
+	config.Headers = headers
+
+	useTLSFiles := *otlpCAFile != "" || *otlpClientCertFile != "" || *otlpClientKeyFile != ""
+	insecureSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "otlp-insecure" {
+			insecureSet = true
+		}
+	})
+	// a receiver on the node, e.g. a collector sidecar, is usually served without TLS
+	if !insecureSet && !useTLSFiles && metrics.IsLoopbackEndpoint(config.Endpoint) {
+		config.Insecure = true
+	}
+	if config.Insecure && useTLSFiles {
+		return config, fmt.Errorf("--otlp-insecure cannot be used with --otlp-ca-file, --otlp-client-cert-file or --otlp-client-key-file")
+	}
+	if useTLSFiles {
+		host, _, err := net.SplitHostPort(config.Endpoint)
+		if err != nil {
+			return config, fmt.Errorf("invalid --otlp-endpoint %q: %w", config.Endpoint, err)
+		}
+		config.TLSConfig, err = utils.NewClientTLSConfig(*otlpCAFile, *otlpClientCertFile, *otlpClientKeyFile, host)
+		if err != nil {
+			return config, fmt.Errorf("failed to create otlp tls config: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// parseHeaders parses a comma separated list of key=value headers.
+func parseHeaders(list string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, entry := range splitList(list) {
+		key, value, ok := strings.Cut(entry, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("invalid header %q, must be key=value", entry)
+		}
+		headers[key] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// parseIDList parses a comma separated list of uids or gids.
+func parseIDList(list string) ([]uint32, error) {
+	var ids []uint32
+	for _, entry := range splitList(list) {
+		id, err := strconv.ParseUint(entry, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q: %w", entry, err)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// splitList returns the non-empty entries of a comma separated list.
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
 }
 
 // withShutdownSignal returns a copy of the parent context that will close if
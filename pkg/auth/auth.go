@@ -9,9 +9,12 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/config"
 	"github.com/Azure/kubernetes-kms/pkg/consts"
@@ -23,9 +26,32 @@ import (
 	"monis.app/mlog"
 )
 
+// msiSender sends the managed identity token requests. The instance metadata service is only
+// reachable from the node, so the requests are never sent through the proxy of the environment.
+var msiSender autorest.Sender = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:    100,
+		IdleConnTimeout: 90 * time.Second,
+	},
+}
+
 // GetKeyvaultToken() returns token for Keyvault endpoint.
-func GetKeyvaultToken(config *config.AzureConfig, env *azure.Environment, resource string, proxyMode bool) (authorizer autorest.Authorizer, err error) {
-	servicePrincipalToken, err := GetServicePrincipalToken(config, env.ActiveDirectoryEndpoint, resource, proxyMode)
+// If sender is not nil, it is used to send the service principal token requests.
+// The token requests are sent through decorators, e.g. to instrument them.
+func GetKeyvaultToken(config *config.AzureConfig, env *azure.Environment, resource string, proxyMode bool, sender autorest.Sender, decorators ...autorest.SendDecorator) (authorizer autorest.Authorizer, err error) {
+	if len(config.KeyVaultAuxiliaryTenantIDs) > 0 {
+		multiTenantToken, err := GetMultiTenantServicePrincipalToken(config, env.ActiveDirectoryEndpoint, resource, proxyMode, sender, decorators...)
+		if err != nil {
+			return nil, err
+		}
+		return autorest.NewMultiTenantServicePrincipalTokenAuthorizer(multiTenantToken), nil
+	}
+
+	servicePrincipalToken, err := GetServicePrincipalToken(config, env.ActiveDirectoryEndpoint, resource, proxyMode, sender, decorators...)
 	if err != nil {
 		return nil, err
 	}
@@ -34,30 +60,40 @@ func GetKeyvaultToken(config *config.AzureConfig, env *azure.Environment, resour
 }
 
 // GetServicePrincipalToken creates a new service principal token based on the configuration.
-func GetServicePrincipalToken(config *config.AzureConfig, aadEndpoint, resource string, proxyMode bool) (adal.OAuthTokenProvider, error) {
-	oauthConfig, err := adal.NewOAuthConfig(aadEndpoint, config.TenantID)
+// Managed identity tokens are requested from the instance metadata service with msiSender.
+func GetServicePrincipalToken(config *config.AzureConfig, aadEndpoint, resource string, proxyMode bool, sender autorest.Sender, decorators ...autorest.SendDecorator) (adal.OAuthTokenProvider, error) {
+	oauthConfig, err := getOAuthConfig(config, aadEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OAuth config, error: %w", err)
 	}
 
 	if config.UseManagedIdentityExtension {
 		mlog.Info("using managed identity extension to retrieve access token")
+		if isCrossTenant(config) {
+			return nil, fmt.Errorf("keyVaultTenantId %s is not supported with managed identity, managed identity tokens are issued by tenant %s", config.KeyVaultTenantID, config.TenantID)
+		}
 		msiEndpoint, err := adal.GetMSIVMEndpoint()
 		if err != nil {
 			return nil, fmt.Errorf("failed to get managed service identity endpoint, error: %w", err)
 		}
+		var spt *adal.ServicePrincipalToken
 		// using user-assigned managed identity to access keyvault
 		if len(config.UserAssignedIdentityID) > 0 {
 			mlog.Info("using User-assigned managed identity to retrieve access token", "clientID", redactClientCredentials(config.UserAssignedIdentityID))
-			return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint,
+			spt, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint,
 				resource,
 				config.UserAssignedIdentityID)
+		} else {
+			mlog.Info("using system-assigned managed identity to retrieve access token")
+			// using system-assigned managed identity to access keyvault
+			spt, err = adal.NewServicePrincipalTokenFromMSI(
+				msiEndpoint,
+				resource)
 		}
-		mlog.Info("using system-assigned managed identity to retrieve access token")
-		// using system-assigned managed identity to access keyvault
-		return adal.NewServicePrincipalTokenFromMSI(
-			msiEndpoint,
-			resource)
+		if err != nil {
+			return nil, err
+		}
+		return configureSender(spt, false, msiSender, decorators...), nil
 	}
 
 	if len(config.ClientSecret) > 0 && len(config.ClientID) > 0 {
@@ -72,21 +108,14 @@ func GetServicePrincipalToken(config *config.AzureConfig, aadEndpoint, resource
 		if err != nil {
 			return nil, err
 		}
-		if proxyMode {
-			return addTargetTypeHeader(spt), nil
-		}
-		return spt, nil
+		return configureSender(spt, proxyMode, sender, decorators...), nil
 	}
 
 	if len(config.AADClientCertPath) > 0 && len(config.AADClientCertPassword) > 0 {
 		mlog.Info("using jwt client_assertion (client_cert+client_private_key) to retrieve access token")
-		certData, err := os.ReadFile(config.AADClientCertPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read client certificate from file %s, error: %w", config.AADClientCertPath, err)
-		}
-		certificate, privateKey, err := decodePkcs12(certData, config.AADClientCertPassword)
+		certificate, privateKey, err := readClientCertificate(config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode the client certificate, error: %w", err)
+			return nil, err
 		}
 		spt, err := adal.NewServicePrincipalTokenFromCertificate(
 			*oauthConfig,
@@ -97,27 +126,142 @@ func GetServicePrincipalToken(config *config.AzureConfig, aadEndpoint, resource
 		if err != nil {
 			return nil, err
 		}
-		if proxyMode {
-			return addTargetTypeHeader(spt), nil
-		}
-		return spt, nil
+		return configureSender(spt, proxyMode, sender, decorators...), nil
 	}
 
 	return nil, fmt.Errorf("no credentials provided for accessing keyvault")
 }
 
+// GetMultiTenantServicePrincipalToken creates a service principal token for the key vault tenant
+// along with auxiliary tokens for each of the configured auxiliary tenants.
+// Only service principals registered as multi-tenant applications are supported.
+func GetMultiTenantServicePrincipalToken(config *config.AzureConfig, aadEndpoint, resource string, proxyMode bool, sender autorest.Sender, decorators ...autorest.SendDecorator) (*adal.MultiTenantServicePrincipalToken, error) {
+	if config.UseManagedIdentityExtension {
+		return nil, fmt.Errorf("keyVaultAuxiliaryTenantIds is not supported with managed identity")
+	}
+	if IsADFS(config) {
+		return nil, fmt.Errorf("keyVaultAuxiliaryTenantIds is not supported with identity system %s", consts.ADFSIdentitySystem)
+	}
+
+	multiTenantOAuthConfig, err := adal.NewMultiTenantOAuthConfig(aadEndpoint, getKeyVaultTenantID(config), config.KeyVaultAuxiliaryTenantIDs, adal.OAuthOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multi-tenant OAuth config, error: %w", err)
+	}
+
+	var mtspt *adal.MultiTenantServicePrincipalToken
+	switch {
+	case len(config.ClientSecret) > 0 && len(config.ClientID) > 0:
+		mlog.Info("azure: using client_id+client_secret to retrieve multi-tenant access token",
+			"clientID", redactClientCredentials(config.ClientID), "auxiliaryTenantIDs", config.KeyVaultAuxiliaryTenantIDs)
+		mtspt, err = adal.NewMultiTenantServicePrincipalToken(
+			multiTenantOAuthConfig,
+			config.ClientID,
+			config.ClientSecret,
+			resource)
+	case len(config.AADClientCertPath) > 0 && len(config.AADClientCertPassword) > 0:
+		mlog.Info("using jwt client_assertion (client_cert+client_private_key) to retrieve multi-tenant access token",
+			"auxiliaryTenantIDs", config.KeyVaultAuxiliaryTenantIDs)
+		certificate, privateKey, certErr := readClientCertificate(config)
+		if certErr != nil {
+			return nil, certErr
+		}
+		mtspt, err = adal.NewMultiTenantServicePrincipalTokenFromCertificate(
+			multiTenantOAuthConfig,
+			config.ClientID,
+			certificate,
+			privateKey,
+			resource)
+	default:
+		return nil, fmt.Errorf("no credentials provided for accessing keyvault")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	configureSender(mtspt.PrimaryToken, proxyMode, sender, decorators...)
+	for _, auxiliaryToken := range mtspt.AuxiliaryTokens {
+		configureSender(auxiliaryToken, proxyMode, sender, decorators...)
+	}
+	return mtspt, nil
+}
+
 // ParseAzureEnvironment returns azure environment by name.
+// For Azure Stack Hub and other custom clouds, the environment is loaded from
+// the file referenced by the AZURE_ENVIRONMENT_FILEPATH environment variable.
 func ParseAzureEnvironment(cloudName string) (*azure.Environment, error) {
 	var env azure.Environment
 	var err error
-	if cloudName == "" {
+	switch {
+	case cloudName == "":
 		env = azure.PublicCloud
-	} else {
+	case strings.EqualFold(cloudName, consts.AzureStackCloudName):
+		env, err = environmentFromFile()
+	default:
 		env, err = azure.EnvironmentFromName(cloudName)
 	}
 	return &env, err
 }
 
+// environmentFromFile loads a custom azure environment from the file referenced by
+// the AZURE_ENVIRONMENT_FILEPATH environment variable.
+func environmentFromFile() (azure.Environment, error) {
+	filePath := os.Getenv(azure.EnvironmentFilepathName)
+	if filePath == "" {
+		return azure.Environment{}, fmt.Errorf("%s must be set for cloud %s", azure.EnvironmentFilepathName, consts.AzureStackCloudName)
+	}
+	mlog.Info("loading azure environment from file", "filePath", filePath)
+	env, err := azure.EnvironmentFromFile(filePath)
+	if err != nil {
+		return azure.Environment{}, fmt.Errorf("failed to load azure environment from file %s, error: %w", filePath, err)
+	}
+	return env, nil
+}
+
+// IsADFS returns true if the identity system in the config is ADFS.
+func IsADFS(config *config.AzureConfig) bool {
+	return strings.EqualFold(config.IdentitySystem, consts.ADFSIdentitySystem)
+}
+
+// getOAuthConfig returns the OAuth config for the configured identity system.
+// ADFS does not use a tenant and its token endpoint does not accept the api-version query parameter.
+func getOAuthConfig(config *config.AzureConfig, aadEndpoint string) (*adal.OAuthConfig, error) {
+	if IsADFS(config) {
+		mlog.Info("using ADFS identity system to retrieve access token")
+		return adal.NewOAuthConfigWithAPIVersion(aadEndpoint, consts.ADFSIdentitySystem, nil)
+	}
+	if isCrossTenant(config) {
+		mlog.Info("requesting access token from key vault tenant", "keyVaultTenantID", config.KeyVaultTenantID)
+	}
+	return adal.NewOAuthConfig(aadEndpoint, getKeyVaultTenantID(config))
+}
+
+// getKeyVaultTenantID returns the tenant to request key vault tokens from.
+// It defaults to the tenant of the cluster identity.
+func getKeyVaultTenantID(config *config.AzureConfig) string {
+	if config.KeyVaultTenantID != "" {
+		return config.KeyVaultTenantID
+	}
+	return config.TenantID
+}
+
+// isCrossTenant returns true if the key vault is in a different tenant than the cluster identity.
+func isCrossTenant(config *config.AzureConfig) bool {
+	return config.KeyVaultTenantID != "" && !strings.EqualFold(config.KeyVaultTenantID, config.TenantID)
+}
+
+// readClientCertificate reads and decodes the PKCS#12 client certificate configured in aadClientCertPath.
+func readClientCertificate(config *config.AzureConfig) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certData, err := os.ReadFile(config.AADClientCertPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client certificate from file %s, error: %w", config.AADClientCertPath, err)
+	}
+	certificate, privateKey, err := decodePkcs12(certData, config.AADClientCertPassword)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode the client certificate, error: %w", err)
+	}
+	return certificate, privateKey, nil
+}
+
 // decodePkcs12 decodes a PKCS#12 client certificate by extracting the public certificate and
 // the private RSA key.
 func decodePkcs12(pkcs []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
@@ -133,22 +277,61 @@ func decodePkcs12(pkcs []byte, password string) (*x509.Certificate, *rsa.Private
 	return certificate, rsaPrivateKey, nil
 }
 
+// redactedValue replaces the value of sensitive settings in the logs.
+const redactedValue = "<redacted>"
+
+// LogAzureConfigSources logs the source of each populated azure config setting.
+// The values of sensitive settings are never logged, not even in part.
+func LogAzureConfigSources(config *config.AzureConfig) {
+	for _, setting := range config.Settings() {
+		mlog.Info("azure config setting", "name", setting.Name, "source", setting.Source, "value", settingLogValue(setting))
+	}
+}
+
+// settingLogValue returns the value of setting as it is logged.
+func settingLogValue(setting config.Setting) string {
+	if setting.Sensitive {
+		return redactedValue
+	}
+	return setting.Value
+}
+
 // redactClientCredentials applies regex to a sensitive string and return the redacted value.
+// Strings shorter than 16 characters are fully redacted, since their first and last 4
+// characters would give away most of them.
 func redactClientCredentials(sensitiveString string) string {
+	if len(sensitiveString) < 16 {
+		return "##### REDACTED #####"
+	}
 	r := regexp.MustCompile(`^(\S{4})(\S|\s)*(\S{4})$`)
 	return r.ReplaceAllString(sensitiveString, "$1##### REDACTED #####$3")
 }
 
-// addTargetTypeHeader adds the target header if proxy mode is enabled.
-func addTargetTypeHeader(spt *adal.ServicePrincipalToken) *adal.ServicePrincipalToken {
-	spt.SetSender(autorest.CreateSender(
-		(func() autorest.SendDecorator {
-			return func(s autorest.Sender) autorest.Sender {
-				return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
-					r.Header.Set(consts.RequestHeaderTargetType, consts.TargetTypeAzureActiveDirectory)
-					return s.Do(r)
-				})
-			}
-		})()))
+// configureSender sets the sender used for token requests if not nil, decorated with decorators.
+// The default sender is decorated if sender is nil. In proxy mode, the target header is added to each request.
+func configureSender(spt *adal.ServicePrincipalToken, proxyMode bool, sender autorest.Sender, decorators ...autorest.SendDecorator) *adal.ServicePrincipalToken {
+	if proxyMode {
+		decorators = append([]autorest.SendDecorator{withTargetTypeHeader()}, decorators...)
+	}
+	if len(decorators) == 0 {
+		if sender != nil {
+			spt.SetSender(sender)
+		}
+		return spt
+	}
+	if sender == nil {
+		sender = autorest.CreateSender()
+	}
+	spt.SetSender(autorest.DecorateSender(sender, decorators...))
 	return spt
 }
+
+// withTargetTypeHeader adds the target header for proxy mode.
+func withTargetTypeHeader() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			r.Header.Set(consts.RequestHeaderTargetType, consts.TargetTypeAzureActiveDirectory)
+			return s.Do(r)
+		})
+	}
+}
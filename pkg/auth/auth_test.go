@@ -6,12 +6,24 @@
 package auth
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/config"
+	"github.com/Azure/kubernetes-kms/pkg/consts"
 
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 )
@@ -37,6 +49,43 @@ func TestParseAzureEnvironment(t *testing.T) {
 	}
 }
 
+func TestParseAzureEnvironmentFromFile(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "azurestackcloud.json")
+	envJSON := `{
+		"name": "AzureStackCloud",
+		"activeDirectoryEndpoint": "https://adfs.local.azurestack.external/",
+		"keyVaultDNSSuffix": "vault.local.azurestack.external",
+		"resourceIdentifiers": {
+			"keyVault": "https://vault.local.azurestack.external/"
+		}
+	}`
+	if err := os.WriteFile(envFile, []byte(envJSON), 0o600); err != nil {
+		t.Fatalf("failed to write environment file: %v", err)
+	}
+
+	t.Setenv(azure.EnvironmentFilepathName, "")
+	if _, err := ParseAzureEnvironment("AzureStackCloud"); err == nil {
+		t.Fatalf("expected error when %s is not set", azure.EnvironmentFilepathName)
+	}
+
+	t.Setenv(azure.EnvironmentFilepathName, filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := ParseAzureEnvironment("AzureStackCloud"); err == nil {
+		t.Fatalf("expected error for missing environment file")
+	}
+
+	t.Setenv(azure.EnvironmentFilepathName, envFile)
+	azureEnv, err := ParseAzureEnvironment("AzureStackCloud")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if azureEnv.KeyVaultDNSSuffix != "vault.local.azurestack.external" {
+		t.Fatalf("expected key vault dns suffix vault.local.azurestack.external, got %s", azureEnv.KeyVaultDNSSuffix)
+	}
+	if azureEnv.ResourceIdentifiers.KeyVault != "https://vault.local.azurestack.external/" {
+		t.Fatalf("expected key vault resource identifier https://vault.local.azurestack.external/, got %s", azureEnv.ResourceIdentifiers.KeyVault)
+	}
+}
+
 func TestRedactClientCredentials(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -48,6 +97,26 @@ func TestRedactClientCredentials(t *testing.T) {
 			clientID: "aabc0000-a83v-9h4m-000j-2c0a66b0c1f9",
 			expected: "aabc##### REDACTED #####c1f9",
 		},
+		{
+			name:     "should fully redact a 1 character secret",
+			clientID: "h",
+			expected: "##### REDACTED #####",
+		},
+		{
+			name:     "should fully redact a 7 character secret",
+			clientID: "hunter2",
+			expected: "##### REDACTED #####",
+		},
+		{
+			name:     "should fully redact an 8 character secret",
+			clientID: "hunter22",
+			expected: "##### REDACTED #####",
+		},
+		{
+			name:     "should fully redact a 15 character secret",
+			clientID: "hunter22hunter2",
+			expected: "##### REDACTED #####",
+		},
 	}
 
 	for _, test := range tests {
@@ -60,6 +129,21 @@ func TestRedactClientCredentials(t *testing.T) {
 	}
 }
 
+func TestSettingLogValue(t *testing.T) {
+	for _, value := range []string{"h", "hu", "hun", "hunt", "hunte", "hunter", "hunter2", "hunter22", "aabc0000-a83v-9h4m-000j-2c0a66b0c1f9"} {
+		t.Run(value, func(t *testing.T) {
+			logged := settingLogValue(config.Setting{Name: "aadClientSecret", Value: value, Sensitive: true})
+			if logged != redactedValue {
+				t.Fatalf("expected: %s, got: %s", redactedValue, logged)
+			}
+		})
+	}
+
+	if logged := settingLogValue(config.Setting{Name: "tenantId", Value: "tenant"}); logged != "tenant" {
+		t.Fatalf("expected: %s, got: %s", "tenant", logged)
+	}
+}
+
 func TestGetServicePrincipalTokenFromMSIWithUserAssignedID(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -91,7 +175,7 @@ func TestGetServicePrincipalTokenFromMSIWithUserAssignedID(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			token, err := GetServicePrincipalToken(test.config, "https://login.microsoftonline.com/", "https://vault.azure.net", test.proxyMode)
+			token, err := GetServicePrincipalToken(test.config, "https://login.microsoftonline.com/", "https://vault.azure.net", test.proxyMode, nil)
 			if err != nil {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
@@ -103,6 +187,7 @@ func TestGetServicePrincipalTokenFromMSIWithUserAssignedID(t *testing.T) {
 			if err != nil {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
+			spt.SetSender(msiSender)
 			if !reflect.DeepEqual(token, spt) {
 				t.Fatalf("expected: %v, got: %v", spt, token)
 			}
@@ -139,7 +224,7 @@ func TestGetServicePrincipalTokenFromMSI(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			token, err := GetServicePrincipalToken(test.config, "https://login.microsoftonline.com/", "https://vault.azure.net", test.proxyMode)
+			token, err := GetServicePrincipalToken(test.config, "https://login.microsoftonline.com/", "https://vault.azure.net", test.proxyMode, nil)
 			if err != nil {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
@@ -151,6 +236,7 @@ func TestGetServicePrincipalTokenFromMSI(t *testing.T) {
 			if err != nil {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
+			spt.SetSender(msiSender)
 			if !reflect.DeepEqual(token, spt) {
 				t.Fatalf("expected: %v, got: %v", spt, token)
 			}
@@ -158,6 +244,68 @@ func TestGetServicePrincipalTokenFromMSI(t *testing.T) {
 	}
 }
 
+func TestGetServicePrincipalTokenFromIMDS(t *testing.T) {
+	t.Setenv("MSI_ENDPOINT", "")
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		t.Errorf("expected managed identity token requests not to be sent through the proxy")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	t.Setenv("HTTP_PROXY", proxy.URL)
+
+	attempts := 0
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// a request sent through a proxy has an absolute uri
+		if r.Host != "169.254.169.254" || !strings.HasPrefix(r.RequestURI, "/metadata/identity/oauth2/token?") {
+			t.Errorf("unexpected request: host %s, uri %s", r.Host, r.RequestURI)
+		}
+		if r.Header.Get("Metadata") != "true" {
+			t.Errorf("expected Metadata header to be true, got: %q", r.Header.Get("Metadata"))
+		}
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token","expires_in":"3600","expires_on":"%d","resource":"https://vault.azure.net","token_type":"Bearer"}`, time.Now().Add(time.Hour).Unix())
+	}))
+	defer imds.Close()
+
+	// the instance metadata service address is dialed on the test server, with the transport of msiSender
+	transport := msiSender.(*http.Client).Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, imds.Listener.Addr().String())
+	}
+	defaultMSISender := msiSender
+	msiSender = &http.Client{Transport: transport}
+	t.Cleanup(func() { msiSender = defaultMSISender })
+
+	sent := 0
+	countSent := func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			sent++
+			return s.Do(r)
+		})
+	}
+	token, err := GetServicePrincipalToken(&config.AzureConfig{UseManagedIdentityExtension: true}, "https://login.microsoftonline.com/", "https://vault.azure.net", false, nil, countSent)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	spt := token.(*adal.ServicePrincipalToken)
+	// the first attempt is retried after 2s
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := spt.RefreshWithContext(ctx); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if spt.OAuthToken() != "token" {
+		t.Fatalf("expected token: %s, got: %s", "token", spt.OAuthToken())
+	}
+	if attempts != 2 || sent != 2 {
+		t.Fatalf("expected 2 attempts through the decorated sender, got: %d attempts, %d sent", attempts, sent)
+	}
+}
+
 func TestGetServicePrincipalToken(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -175,7 +323,7 @@ func TestGetServicePrincipalToken(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			token, err := GetServicePrincipalToken(test.config, "https://login.microsoftonline.com/", "https://vault.azure.net", false)
+			token, err := GetServicePrincipalToken(test.config, "https://login.microsoftonline.com/", "https://vault.azure.net", false, nil)
 			if err != nil {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
@@ -195,3 +343,146 @@ func TestGetServicePrincipalToken(t *testing.T) {
 		})
 	}
 }
+
+func TestGetServicePrincipalTokenWithADFS(t *testing.T) {
+	cfg := &config.AzureConfig{
+		TenantID:       "TenantID",
+		ClientID:       "AADClientID",
+		ClientSecret:   "AADClientSecret",
+		IdentitySystem: "ADFS",
+	}
+	aadEndpoint := "https://adfs.local.azurestack.external/"
+
+	token, err := GetServicePrincipalToken(cfg, aadEndpoint, "https://vault.local.azurestack.external", false, nil)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	oauthConfig, err := adal.NewOAuthConfigWithAPIVersion(aadEndpoint, "adfs", nil)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	spt, err := adal.NewServicePrincipalToken(*oauthConfig, cfg.ClientID, cfg.ClientSecret, "https://vault.local.azurestack.external")
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if !reflect.DeepEqual(token, spt) {
+		t.Fatalf("expected: %+v, got: %+v", spt, token)
+	}
+}
+
+func TestGetKeyvaultTokenCrossTenant(t *testing.T) {
+	var mu sync.Mutex
+	var requestedTenants []string
+	fakeAAD := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// token requests are sent to /<tenant>/oauth2/token
+		tenant := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+		mu.Lock()
+		requestedTenants = append(requestedTenants, tenant)
+		mu.Unlock()
+		if r.Header.Get(consts.RequestHeaderTargetType) != consts.TargetTypeAzureActiveDirectory {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%s","token_type":"Bearer","expires_in":"3600","expires_on":"%d","resource":"https://vault.azure.net"}`,
+			tenant, time.Now().Add(time.Hour).Unix())
+	}))
+	defer fakeAAD.Close()
+
+	tests := []struct {
+		desc                   string
+		config                 *config.AzureConfig
+		expectedTenants        []string
+		expectedAuthorization  string
+		expectedAuxAuthorizers string
+	}{
+		{
+			desc: "token requested from key vault tenant",
+			config: &config.AzureConfig{
+				TenantID:         "clustertenant",
+				KeyVaultTenantID: "kvtenant",
+				ClientID:         "AADClientID",
+				ClientSecret:     "AADClientSecret",
+			},
+			expectedTenants:       []string{"kvtenant"},
+			expectedAuthorization: "Bearer token-kvtenant",
+		},
+		{
+			desc: "token requested from key vault tenant with auxiliary tenants",
+			config: &config.AzureConfig{
+				TenantID:                   "clustertenant",
+				KeyVaultTenantID:           "kvtenant",
+				KeyVaultAuxiliaryTenantIDs: []string{"auxtenant1", "auxtenant2"},
+				ClientID:                   "AADClientID",
+				ClientSecret:               "AADClientSecret",
+			},
+			expectedTenants:        []string{"auxtenant1", "auxtenant2", "kvtenant"},
+			expectedAuthorization:  "Bearer token-kvtenant",
+			expectedAuxAuthorizers: "Bearer token-auxtenant1, Bearer token-auxtenant2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			mu.Lock()
+			requestedTenants = nil
+			mu.Unlock()
+
+			env := &azure.Environment{ActiveDirectoryEndpoint: fakeAAD.URL + "/"}
+			authorizer, err := GetKeyvaultToken(test.config, env, "https://vault.azure.net", true, nil)
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			req, err := autorest.Prepare(httptest.NewRequest(http.MethodPost, "https://testkv.vault.azure.net/keys/key1/encrypt", nil), authorizer.WithAuthorization())
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if got := req.Header.Get("Authorization"); got != test.expectedAuthorization {
+				t.Fatalf("expected authorization header: %s, got: %s", test.expectedAuthorization, got)
+			}
+			if got := req.Header.Get("x-ms-authorization-auxiliary"); got != test.expectedAuxAuthorizers {
+				t.Fatalf("expected auxiliary authorization header: %s, got: %s", test.expectedAuxAuthorizers, got)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			sort.Strings(requestedTenants)
+			if !reflect.DeepEqual(requestedTenants, test.expectedTenants) {
+				t.Fatalf("expected token requests to tenants: %v, got: %v", test.expectedTenants, requestedTenants)
+			}
+		})
+	}
+}
+
+func TestGetServicePrincipalTokenCrossTenantError(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config *config.AzureConfig
+	}{
+		{
+			desc: "key vault tenant with managed identity",
+			config: &config.AzureConfig{
+				TenantID:                    "clustertenant",
+				KeyVaultTenantID:            "kvtenant",
+				UseManagedIdentityExtension: true,
+			},
+		},
+		{
+			desc: "auxiliary tenants with managed identity",
+			config: &config.AzureConfig{
+				KeyVaultAuxiliaryTenantIDs:  []string{"auxtenant"},
+				UseManagedIdentityExtension: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if _, err := GetKeyvaultToken(test.config, &azure.PublicCloud, "https://vault.azure.net", false, nil); err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+		})
+	}
+}
@@ -3,11 +3,25 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 	"monis.app/mlog"
 )
 
+// Source is where an AzureConfig setting was loaded from.
+type Source string
+
+const (
+	// SourceConfigFile is set for settings loaded from the azure.json config file.
+	SourceConfigFile Source = "configFile"
+	// SourceEnvironment is set for settings loaded from AZURE_KMS_* environment variables.
+	SourceEnvironment Source = "environment"
+	// SourceSecretFile is set for secrets loaded from their own file, e.g. aadClientSecretFile.
+	SourceSecretFile Source = "secretFile"
+)
+
 // AzureConfig is representing /etc/kubernetes/azure.json.
 type AzureConfig struct {
 	Cloud                       string `json:"cloud" yaml:"cloud"`
@@ -18,19 +32,173 @@ type AzureConfig struct {
 	UserAssignedIdentityID      string `json:"userAssignedIdentityID,omitempty" yaml:"userAssignedIdentityID,omitempty"`
 	AADClientCertPath           string `json:"aadClientCertPath" yaml:"aadClientCertPath"`
 	AADClientCertPassword       string `json:"aadClientCertPassword" yaml:"aadClientCertPassword"`
+	IdentitySystem              string `json:"identitySystem,omitempty" yaml:"identitySystem,omitempty"`
+	// AADClientSecretFile and AADClientCertPasswordFile point to files containing the secret.
+	// When set, they take precedence over aadClientSecret and aadClientCertPassword.
+	AADClientSecretFile       string `json:"aadClientSecretFile,omitempty" yaml:"aadClientSecretFile,omitempty"`
+	AADClientCertPasswordFile string `json:"aadClientCertPasswordFile,omitempty" yaml:"aadClientCertPasswordFile,omitempty"`
+	// KeyVaultTenantID is the tenant of the key vault if it differs from the cluster identity tenant.
+	// KeyVaultAuxiliaryTenantIDs are additional tenants a multi-tenant app registration requests tokens from.
+	KeyVaultTenantID           string   `json:"keyVaultTenantId,omitempty" yaml:"keyVaultTenantId,omitempty"`
+	KeyVaultAuxiliaryTenantIDs []string `json:"keyVaultAuxiliaryTenantIds,omitempty" yaml:"keyVaultAuxiliaryTenantIds,omitempty"`
+
+	sources map[string]Source
+}
+
+// Setting is a populated AzureConfig setting along with the source it was loaded from.
+type Setting struct {
+	Name      string
+	Value     string
+	Source    Source
+	Sensitive bool
+}
+
+// setting describes an AzureConfig field that can be overridden from the environment.
+type setting struct {
+	name      string
+	envVar    string
+	sensitive bool
+	get       func(cfg *AzureConfig) string
+	set       func(cfg *AzureConfig, value string) error
+}
+
+var settings = []setting{
+	stringSetting("cloud", "AZURE_KMS_CLOUD", false, func(cfg *AzureConfig) *string { return &cfg.Cloud }),
+	stringSetting("tenantId", "AZURE_KMS_TENANT_ID", false, func(cfg *AzureConfig) *string { return &cfg.TenantID }),
+	stringSetting("aadClientId", "AZURE_KMS_CLIENT_ID", true, func(cfg *AzureConfig) *string { return &cfg.ClientID }),
+	stringSetting("aadClientSecret", "AZURE_KMS_CLIENT_SECRET", true, func(cfg *AzureConfig) *string { return &cfg.ClientSecret }),
+	{
+		name:   "useManagedIdentityExtension",
+		envVar: "AZURE_KMS_USE_MANAGED_IDENTITY_EXTENSION",
+		get: func(cfg *AzureConfig) string {
+			if !cfg.UseManagedIdentityExtension {
+				return ""
+			}
+			return strconv.FormatBool(cfg.UseManagedIdentityExtension)
+		},
+		set: func(cfg *AzureConfig, value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			cfg.UseManagedIdentityExtension = b
+			return nil
+		},
+	},
+	stringSetting("userAssignedIdentityID", "AZURE_KMS_USER_ASSIGNED_IDENTITY_ID", true, func(cfg *AzureConfig) *string { return &cfg.UserAssignedIdentityID }),
+	stringSetting("aadClientCertPath", "AZURE_KMS_CLIENT_CERTIFICATE_PATH", false, func(cfg *AzureConfig) *string { return &cfg.AADClientCertPath }),
+	stringSetting("aadClientCertPassword", "AZURE_KMS_CLIENT_CERTIFICATE_PASSWORD", true, func(cfg *AzureConfig) *string { return &cfg.AADClientCertPassword }),
+	stringSetting("identitySystem", "AZURE_KMS_IDENTITY_SYSTEM", false, func(cfg *AzureConfig) *string { return &cfg.IdentitySystem }),
+	stringSetting("aadClientSecretFile", "AZURE_KMS_CLIENT_SECRET_FILE", false, func(cfg *AzureConfig) *string { return &cfg.AADClientSecretFile }),
+	stringSetting("aadClientCertPasswordFile", "AZURE_KMS_CLIENT_CERTIFICATE_PASSWORD_FILE", false, func(cfg *AzureConfig) *string { return &cfg.AADClientCertPasswordFile }),
+	stringSetting("keyVaultTenantId", "AZURE_KMS_KEYVAULT_TENANT_ID", false, func(cfg *AzureConfig) *string { return &cfg.KeyVaultTenantID }),
+	{
+		name:   "keyVaultAuxiliaryTenantIds",
+		envVar: "AZURE_KMS_KEYVAULT_AUXILIARY_TENANT_IDS",
+		get:    func(cfg *AzureConfig) string { return strings.Join(cfg.KeyVaultAuxiliaryTenantIDs, ",") },
+		set: func(cfg *AzureConfig, value string) error {
+			cfg.KeyVaultAuxiliaryTenantIDs = nil
+			for _, tenantID := range strings.Split(value, ",") {
+				if tenantID = strings.TrimSpace(tenantID); tenantID != "" {
+					cfg.KeyVaultAuxiliaryTenantIDs = append(cfg.KeyVaultAuxiliaryTenantIDs, tenantID)
+				}
+			}
+			return nil
+		},
+	},
+}
+
+func stringSetting(name, envVar string, sensitive bool, field func(cfg *AzureConfig) *string) setting {
+	return setting{
+		name:      name,
+		envVar:    envVar,
+		sensitive: sensitive,
+		get:       func(cfg *AzureConfig) string { return *field(cfg) },
+		set: func(cfg *AzureConfig, value string) error {
+			*field(cfg) = value
+			return nil
+		},
+	}
 }
 
 // GetAzureConfig returns configs in the azure.json cloud provider file.
+// Each setting can be overridden by its AZURE_KMS_* environment variable when it is not empty, and
+// secrets are read from aadClientSecretFile and aadClientCertPasswordFile when set.
+// The config file is skipped if configFile is empty.
 func GetAzureConfig(configFile string) (config *AzureConfig, err error) {
 	cfg := AzureConfig{}
 
-	mlog.Trace("populating AzureConfig from config file", "configFile", configFile)
-	bytes, err := os.ReadFile(configFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load config file %s, error: %w", configFile, err)
+	if configFile != "" {
+		mlog.Trace("populating AzureConfig from config file", "configFile", configFile)
+		bytes, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file %s, error: %w", configFile, err)
+		}
+		if err = yaml.Unmarshal(bytes, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal azure.json, error: %w", err)
+		}
 	}
-	if err = yaml.Unmarshal(bytes, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal azure.json, error: %w", err)
+
+	cfg.sources = make(map[string]Source)
+	for _, s := range settings {
+		if s.get(&cfg) != "" {
+			cfg.sources[s.name] = SourceConfigFile
+		}
+	}
+
+	for _, s := range settings {
+		// an empty variable does not wipe the value of the config file
+		value := os.Getenv(s.envVar)
+		if value == "" {
+			continue
+		}
+		mlog.Trace("overriding AzureConfig setting from environment", "setting", s.name, "envVar", s.envVar)
+		if err := s.set(&cfg, value); err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable %s, error: %w", s.envVar, err)
+		}
+		cfg.sources[s.name] = SourceEnvironment
 	}
+
+	if cfg.AADClientSecretFile != "" {
+		if cfg.ClientSecret, err = readSecretFile(cfg.AADClientSecretFile); err != nil {
+			return nil, err
+		}
+		cfg.sources["aadClientSecret"] = SourceSecretFile
+	}
+	if cfg.AADClientCertPasswordFile != "" {
+		if cfg.AADClientCertPassword, err = readSecretFile(cfg.AADClientCertPasswordFile); err != nil {
+			return nil, err
+		}
+		cfg.sources["aadClientCertPassword"] = SourceSecretFile
+	}
+
 	return &cfg, nil
 }
+
+// Settings returns the populated settings of the config along with their source.
+func (c *AzureConfig) Settings() []Setting {
+	var populated []Setting
+	for _, s := range settings {
+		value := s.get(c)
+		if value == "" {
+			continue
+		}
+		populated = append(populated, Setting{
+			Name:      s.name,
+			Value:     value,
+			Source:    c.sources[s.name],
+			Sensitive: s.sensitive,
+		})
+	}
+	return populated
+}
+
+// readSecretFile returns the content of the secret file with surrounding whitespace removed.
+func readSecretFile(path string) (string, error) {
+	mlog.Trace("reading secret from file", "path", path)
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %s, error: %w", path, err)
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetAzureConfig(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "azure.json")
+	configJSON := `{
+		"cloud": "AzurePublicCloud",
+		"tenantId": "TenantID",
+		"aadClientId": "AADClientID",
+		"aadClientSecret": "AADClientSecret"
+	}`
+	if err := os.WriteFile(configFile, []byte(configJSON), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	secretFile := filepath.Join(dir, "client-secret")
+	if err := os.WriteFile(secretFile, []byte("SecretFromFile\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+
+	tests := []struct {
+		desc            string
+		configFile      string
+		env             map[string]string
+		expectedConfig  AzureConfig
+		expectedSources map[string]Source
+		expectedError   bool
+	}{
+		{
+			desc:       "config file only",
+			configFile: configFile,
+			expectedConfig: AzureConfig{
+				Cloud:        "AzurePublicCloud",
+				TenantID:     "TenantID",
+				ClientID:     "AADClientID",
+				ClientSecret: "AADClientSecret",
+			},
+			expectedSources: map[string]Source{
+				"cloud":           SourceConfigFile,
+				"tenantId":        SourceConfigFile,
+				"aadClientId":     SourceConfigFile,
+				"aadClientSecret": SourceConfigFile,
+			},
+		},
+		{
+			desc:       "environment overrides config file",
+			configFile: configFile,
+			env: map[string]string{
+				"AZURE_KMS_TENANT_ID":                      "EnvTenantID",
+				"AZURE_KMS_USE_MANAGED_IDENTITY_EXTENSION": "true",
+			},
+			expectedConfig: AzureConfig{
+				Cloud:                       "AzurePublicCloud",
+				TenantID:                    "EnvTenantID",
+				ClientID:                    "AADClientID",
+				ClientSecret:                "AADClientSecret",
+				UseManagedIdentityExtension: true,
+			},
+			expectedSources: map[string]Source{
+				"cloud":                       SourceConfigFile,
+				"tenantId":                    SourceEnvironment,
+				"aadClientId":                 SourceConfigFile,
+				"aadClientSecret":             SourceConfigFile,
+				"useManagedIdentityExtension": SourceEnvironment,
+			},
+		},
+		{
+			desc:       "empty and generic environment variables are ignored",
+			configFile: configFile,
+			env: map[string]string{
+				"AZURE_KMS_TENANT_ID": "",
+				"AZURE_CLIENT_ID":     "WorkloadIdentityClientID",
+				"AZURE_TENANT_ID":     "WorkloadIdentityTenantID",
+			},
+			expectedConfig: AzureConfig{
+				Cloud:        "AzurePublicCloud",
+				TenantID:     "TenantID",
+				ClientID:     "AADClientID",
+				ClientSecret: "AADClientSecret",
+			},
+			expectedSources: map[string]Source{
+				"cloud":           SourceConfigFile,
+				"tenantId":        SourceConfigFile,
+				"aadClientId":     SourceConfigFile,
+				"aadClientSecret": SourceConfigFile,
+			},
+		},
+		{
+			desc: "environment and secret file without config file",
+			env: map[string]string{
+				"AZURE_KMS_TENANT_ID":          "EnvTenantID",
+				"AZURE_KMS_CLIENT_ID":          "EnvClientID",
+				"AZURE_KMS_CLIENT_SECRET_FILE": secretFile,
+			},
+			expectedConfig: AzureConfig{
+				TenantID:            "EnvTenantID",
+				ClientID:            "EnvClientID",
+				ClientSecret:        "SecretFromFile",
+				AADClientSecretFile: secretFile,
+			},
+			expectedSources: map[string]Source{
+				"tenantId":            SourceEnvironment,
+				"aadClientId":         SourceEnvironment,
+				"aadClientSecret":     SourceSecretFile,
+				"aadClientSecretFile": SourceEnvironment,
+			},
+		},
+		{
+			desc:          "missing config file",
+			configFile:    filepath.Join(dir, "missing.json"),
+			expectedError: true,
+		},
+		{
+			desc: "missing secret file",
+			env: map[string]string{
+				"AZURE_KMS_CLIENT_CERTIFICATE_PASSWORD_FILE": filepath.Join(dir, "missing"),
+			},
+			expectedError: true,
+		},
+		{
+			desc: "invalid boolean in environment",
+			env: map[string]string{
+				"AZURE_KMS_USE_MANAGED_IDENTITY_EXTENSION": "maybe",
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			// clear the variables set in the environment of the test
+			for _, s := range settings {
+				t.Setenv(s.envVar, "")
+			}
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := GetAzureConfig(test.configFile)
+			if test.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			actual := *cfg
+			actual.sources = nil
+			if !reflect.DeepEqual(actual, test.expectedConfig) {
+				t.Fatalf("expected config: %+v, got: %+v", test.expectedConfig, actual)
+			}
+
+			settings := cfg.Settings()
+			if len(settings) != len(test.expectedSources) {
+				t.Fatalf("expected %d settings, got: %+v", len(test.expectedSources), settings)
+			}
+			for _, setting := range settings {
+				if setting.Source != test.expectedSources[setting.Name] {
+					t.Fatalf("expected source of %s to be %s, got: %s", setting.Name, test.expectedSources[setting.Name], setting.Source)
+				}
+			}
+		})
+	}
+}
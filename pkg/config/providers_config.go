@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"monis.app/mlog"
+)
+
+// ProvidersConfig lists the KMS providers hosted by one plugin process.
+type ProvidersConfig struct {
+	Providers []ProviderConfig `json:"providers" yaml:"providers"`
+}
+
+// ProviderConfig is a KMS provider with its own listen socket, key and identity.
+// Settings that are not set fall back to the command line flags of the plugin.
+type ProviderConfig struct {
+	// Name tags the metrics of the provider and must be unique.
+	Name       string `json:"name" yaml:"name"`
+	ListenAddr string `json:"listenAddr" yaml:"listenAddr"`
+	// KeyVaultName, VaultURL, KeyName, KeyVersion, KeyID and ManagedHSM have the same meaning
+	// as the --keyvault-name, --vault-url, --key-name, --key-version, --key-id and --managed-hsm flags.
+	KeyVaultName string `json:"keyvaultName,omitempty" yaml:"keyvaultName,omitempty"`
+	VaultURL     string `json:"vaultURL,omitempty" yaml:"vaultURL,omitempty"`
+	KeyName      string `json:"keyName,omitempty" yaml:"keyName,omitempty"`
+	KeyVersion   string `json:"keyVersion,omitempty" yaml:"keyVersion,omitempty"`
+	KeyID        string `json:"keyID,omitempty" yaml:"keyID,omitempty"`
+	ManagedHSM   bool   `json:"managedHSM,omitempty" yaml:"managedHSM,omitempty"`
+	// ConfigFilePath is the azure.json with the identity of the provider.
+	ConfigFilePath string `json:"configFilePath,omitempty" yaml:"configFilePath,omitempty"`
+	// HealthzPath is the path of the provider health check, served on the shared health check port.
+	HealthzPath string `json:"healthzPath" yaml:"healthzPath"`
+}
+
+// GetProvidersConfig returns the providers listed in the config file.
+// Names, listen addresses and health check paths must be unique. The health check paths must
+// not be one of reservedPaths, the other paths served on the health check port.
+func GetProvidersConfig(configFile string, reservedPaths ...string) (*ProvidersConfig, error) {
+	mlog.Trace("populating ProvidersConfig from config file", "configFile", configFile)
+	bytes, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load providers config file %s, error: %w", configFile, err)
+	}
+	cfg := ProvidersConfig{}
+	if err = yaml.Unmarshal(bytes, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal providers config, error: %w", err)
+	}
+	if err = cfg.validate(reservedPaths); err != nil {
+		return nil, fmt.Errorf("invalid providers config %s, error: %w", configFile, err)
+	}
+	return &cfg, nil
+}
+
+func (c *ProvidersConfig) validate(reservedPaths []string) error {
+	if len(c.Providers) == 0 {
+		return fmt.Errorf("no providers configured")
+	}
+	names := make(map[string]bool)
+	listenAddrs := make(map[string]bool)
+	healthzPaths := make(map[string]bool)
+	for i, p := range c.Providers {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("provider %d has no name", i)
+		case p.ListenAddr == "":
+			return fmt.Errorf("provider %s has no listenAddr", p.Name)
+		case p.HealthzPath == "":
+			return fmt.Errorf("provider %s has no healthzPath", p.Name)
+		case names[p.Name]:
+			return fmt.Errorf("duplicate provider name %s", p.Name)
+		case listenAddrs[p.ListenAddr]:
+			return fmt.Errorf("provider %s reuses listenAddr %s", p.Name, p.ListenAddr)
+		case healthzPaths[p.HealthzPath]:
+			return fmt.Errorf("provider %s reuses healthzPath %s", p.Name, p.HealthzPath)
+		}
+		if err := ValidateHealthzPath(p.HealthzPath, reservedPaths...); err != nil {
+			return fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+		names[p.Name] = true
+		listenAddrs[p.ListenAddr] = true
+		healthzPaths[p.HealthzPath] = true
+	}
+	return nil
+}
+
+// ValidateHealthzPath checks that path can be served on the health check port: it starts
+// with "/" and is not one of reservedPaths. Empty reserved paths are not served and ignored.
+func ValidateHealthzPath(path string, reservedPaths ...string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid healthzPath %q, must start with /", path)
+	}
+	for _, reserved := range reservedPaths {
+		if reserved != "" && path == reserved {
+			return fmt.Errorf("healthzPath %s is also used by the liveness or readiness check", path)
+		}
+	}
+	return nil
+}
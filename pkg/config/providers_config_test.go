@@ -0,0 +1,185 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetProvidersConfig(t *testing.T) {
+	tests := []struct {
+		desc           string
+		config         string
+		reservedPaths  []string
+		expectedConfig *ProvidersConfig
+		expectedError  bool
+	}{
+		{
+			desc: "multiple providers",
+			config: `
+providers:
+  - name: current
+    listenAddr: unix:///opt/current.socket
+    keyvaultName: vault-a
+    keyName: key-a
+    keyVersion: "1"
+    healthzPath: /healthz/current
+  - name: tenant-b
+    listenAddr: unix:///opt/tenant-b.socket
+    keyID: https://vault-b.vault.azure.net/keys/key-b/2
+    configFilePath: /etc/kubernetes/tenant-b.json
+    healthzPath: /healthz/tenant-b
+`,
+			expectedConfig: &ProvidersConfig{
+				Providers: []ProviderConfig{
+					{
+						Name:         "current",
+						ListenAddr:   "unix:///opt/current.socket",
+						KeyVaultName: "vault-a",
+						KeyName:      "key-a",
+						KeyVersion:   "1",
+						HealthzPath:  "/healthz/current",
+					},
+					{
+						Name:           "tenant-b",
+						ListenAddr:     "unix:///opt/tenant-b.socket",
+						KeyID:          "https://vault-b.vault.azure.net/keys/key-b/2",
+						ConfigFilePath: "/etc/kubernetes/tenant-b.json",
+						HealthzPath:    "/healthz/tenant-b",
+					},
+				},
+			},
+		},
+		{
+			desc:          "no providers",
+			config:        `providers: []`,
+			expectedError: true,
+		},
+		{
+			desc: "missing name",
+			config: `
+providers:
+  - listenAddr: unix:///opt/a.socket
+    healthzPath: /healthz/a
+`,
+			expectedError: true,
+		},
+		{
+			desc: "missing healthz path",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+`,
+			expectedError: true,
+		},
+		{
+			desc: "duplicate name",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /healthz/a
+  - name: a
+    listenAddr: unix:///opt/b.socket
+    healthzPath: /healthz/b
+`,
+			expectedError: true,
+		},
+		{
+			desc: "duplicate listen address",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /healthz/a
+  - name: b
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /healthz/b
+`,
+			expectedError: true,
+		},
+		{
+			desc: "duplicate healthz path",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /healthz
+  - name: b
+    listenAddr: unix:///opt/b.socket
+    healthzPath: /healthz
+`,
+			expectedError: true,
+		},
+		{
+			desc: "healthz path without leading slash",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: healthz
+`,
+			expectedError: true,
+		},
+		{
+			desc: "healthz path of the liveness check",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /livez
+`,
+			reservedPaths: []string{"/livez", "/readyz"},
+			expectedError: true,
+		},
+		{
+			desc: "healthz path of the readiness check",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /readyz
+`,
+			reservedPaths: []string{"/livez", "/readyz"},
+			expectedError: true,
+		},
+		{
+			desc: "healthz path of a disabled readiness check",
+			config: `
+providers:
+  - name: a
+    listenAddr: unix:///opt/a.socket
+    healthzPath: /healthz
+`,
+			reservedPaths: []string{"/livez", ""},
+			expectedConfig: &ProvidersConfig{Providers: []ProviderConfig{
+				{Name: "a", ListenAddr: "unix:///opt/a.socket", HealthzPath: "/healthz"},
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "providers.yaml")
+			if err := os.WriteFile(configFile, []byte(test.config), 0o600); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			actual, err := GetProvidersConfig(configFile, test.reservedPaths...)
+			if test.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if !reflect.DeepEqual(test.expectedConfig, actual) {
+				t.Fatalf("expected config: %+v, got: %+v", test.expectedConfig, actual)
+			}
+		})
+	}
+}
@@ -14,3 +14,12 @@ const (
 	TargetTypeAzureActiveDirectory = "AzureActiveDirectory"
 	TargetTypeKeyVault             = "KeyVault"
 )
+
+const (
+	// AzureStackCloudName is the cloud name used for Azure Stack Hub and other custom clouds.
+	// The environment for this cloud is loaded from the file referenced by AZURE_ENVIRONMENT_FILEPATH.
+	AzureStackCloudName = "AZURESTACKCLOUD"
+	// ADFSIdentitySystem is the identity system used by clouds that authenticate with
+	// Active Directory Federation Services instead of Azure Active Directory.
+	ADFSIdentitySystem = "adfs"
+)
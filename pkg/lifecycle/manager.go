@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"monis.app/mlog"
+)
+
+// server is a long running server started by the Manager.
+type server struct {
+	name  string
+	serve func() error
+}
+
+// ShutdownOptions configures how a Manager shuts down.
+type ShutdownOptions struct {
+	// Delay is the time to wait after the shutdown hooks ran and before requests are drained,
+	// so kubelet and load balancers observe the failing readiness checks first.
+	Delay time.Duration
+	// GRPCTimeout bounds the time in-flight gRPC requests are drained.
+	GRPCTimeout time.Duration
+	// HTTPTimeout bounds the time in-flight HTTP requests are drained.
+	HTTPTimeout time.Duration
+}
+
+// Manager starts the gRPC and HTTP servers of a process and propagates their errors.
+// When the context is done or a server fails, it shuts down in order: the shutdown hooks
+// run first so readiness checks fail, and the shutdown delay passes so probes observe it.
+// Then in-flight gRPC requests are drained, then the HTTP servers are stopped, each for at
+// most its own timeout, and the closers are closed.
+type Manager struct {
+	opts ShutdownOptions
+
+	servers       []server
+	grpcServers   []*grpc.Server
+	httpServers   []*http.Server
+	shutdownHooks []func()
+	closers       []io.Closer
+}
+
+// NewManager returns a Manager that shuts down with opts.
+func NewManager(opts ShutdownOptions) *Manager {
+	return &Manager{opts: opts}
+}
+
+// AddGRPCServer registers s to serve on listener when Run is called.
+func (m *Manager) AddGRPCServer(name string, s *grpc.Server, listener net.Listener) {
+	m.grpcServers = append(m.grpcServers, s)
+	m.servers = append(m.servers, server{
+		name:  name,
+		serve: func() error { return s.Serve(listener) },
+	})
+}
+
+// AddHTTPServer listens on the address of s, and registers s to serve when Run is called.
+// The address is bound immediately, so errors such as a port in use are returned here.
+func (m *Manager) AddHTTPServer(name string, s *http.Server) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for %s, error: %w", s.Addr, name, err)
+	}
+	m.httpServers = append(m.httpServers, s)
+	m.servers = append(m.servers, server{
+		name: name,
+		serve: func() error {
+			if s.TLSConfig != nil {
+				// the certificate is already loaded in the tls config
+				return s.ServeTLS(listener, "", "")
+			}
+			return s.Serve(listener)
+		},
+	})
+	return nil
+}
+
+// OnShutdown registers fn to run before the servers are stopped, e.g. to fail readiness checks.
+func (m *Manager) OnShutdown(fn func()) {
+	m.shutdownHooks = append(m.shutdownHooks, fn)
+}
+
+// AddCloser registers c to be closed after all servers are stopped, e.g. to remove a unix socket.
+func (m *Manager) AddCloser(c io.Closer) {
+	m.closers = append(m.closers, c)
+}
+
+// Run starts all servers and blocks until ctx is done or a server fails, and then shuts down.
+// It returns the error of the first server that failed.
+func (m *Manager) Run(ctx context.Context) error {
+	errCh := make(chan error, len(m.servers))
+	for _, s := range m.servers {
+		go func(s server) {
+			mlog.Always("starting server", "server", s.name)
+			err := s.serve()
+			if err == nil || errors.Is(err, http.ErrServerClosed) {
+				err = fmt.Errorf("%s stopped unexpectedly", s.name)
+			}
+			errCh <- fmt.Errorf("failed to serve %s: %w", s.name, err)
+		}(s)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		mlog.Always("shutting down")
+	case err = <-errCh:
+		mlog.Error("shutting down after server failure", err)
+	}
+	m.shutdown()
+	return err
+}
+
+func (m *Manager) shutdown() {
+	for _, fn := range m.shutdownHooks {
+		fn()
+	}
+
+	if m.opts.Delay > 0 {
+		mlog.Always("waiting before draining requests", "delay", m.opts.Delay)
+		time.Sleep(m.opts.Delay)
+	}
+
+	// the HTTP servers keep serving health checks and metrics while gRPC requests are drained
+	m.stopGRPCServers()
+	m.stopHTTPServers()
+
+	for _, c := range m.closers {
+		if err := c.Close(); err != nil {
+			mlog.Error("failed to close", err)
+		}
+	}
+	mlog.Always("shutdown complete")
+}
+
+func (m *Manager) stopGRPCServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.GRPCTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range m.grpcServers {
+		wg.Add(1)
+		go func(s *grpc.Server) {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				s.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				mlog.Warning("timed out draining gRPC requests, closing remaining connections", "timeout", m.opts.GRPCTimeout)
+				s.Stop()
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (m *Manager) stopHTTPServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.HTTPTimeout)
+	defer cancel()
+
+	for _, s := range m.httpServers {
+		if err := s.Shutdown(ctx); err != nil {
+			mlog.Warning("failed to gracefully shut down http server, closing it", "addr", s.Addr, "error", err)
+			s.Close()
+		}
+	}
+}
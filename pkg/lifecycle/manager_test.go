@@ -0,0 +1,129 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+type fakeCloser struct {
+	closed bool
+}
+
+func (c *fakeCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestManagerRun(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "kms.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	m := NewManager(ShutdownOptions{GRPCTimeout: 5 * time.Second, HTTPTimeout: 5 * time.Second})
+	m.AddGRPCServer("kms server", grpc.NewServer(), listener)
+	if err := m.AddHTTPServer("healthz", &http.Server{Addr: "localhost:0", ReadHeaderTimeout: time.Second}); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	var order []string
+	m.OnShutdown(func() { order = append(order, "readiness") })
+	closer := &fakeCloser{}
+	m.AddCloser(closer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.Run(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for shutdown")
+	}
+	if len(order) != 1 || order[0] != "readiness" {
+		t.Fatalf("expected shutdown hook to run, got: %v", order)
+	}
+	if !closer.closed {
+		t.Fatalf("expected closer to be closed")
+	}
+}
+
+func TestManagerRunShutdownDelay(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "kms.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	delay := 200 * time.Millisecond
+	m := NewManager(ShutdownOptions{Delay: delay, GRPCTimeout: time.Second, HTTPTimeout: time.Second})
+	m.AddGRPCServer("kms server", grpc.NewServer(), listener)
+
+	// the servers are only stopped once the delay after the shutdown hooks passed
+	hookDone := make(chan time.Time, 1)
+	m.OnShutdown(func() { hookDone <- time.Now() })
+	closer := &fakeCloser{}
+	m.AddCloser(closer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Run(ctx); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if elapsed := time.Since(<-hookDone); elapsed < delay {
+		t.Fatalf("expected servers to stop at least %v after the shutdown hooks, got: %v", delay, elapsed)
+	}
+	if !closer.closed {
+		t.Fatalf("expected closer to be closed")
+	}
+}
+
+func TestManagerRunServerFailure(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "kms.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	// the server fails to accept connections on a closed listener
+	listener.Close()
+
+	m := NewManager(ShutdownOptions{GRPCTimeout: 5 * time.Second, HTTPTimeout: 5 * time.Second})
+	m.AddGRPCServer("kms server", grpc.NewServer(), listener)
+	closer := &fakeCloser{}
+	m.AddCloser(closer)
+
+	if err := m.Run(context.Background()); err == nil {
+		t.Fatalf("expected error for failed server, got nil")
+	}
+	if !closer.closed {
+		t.Fatalf("expected closer to be closed")
+	}
+}
+
+func TestManagerAddHTTPServerPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	m := NewManager(ShutdownOptions{GRPCTimeout: time.Second, HTTPTimeout: time.Second})
+	if err := m.AddHTTPServer("healthz", &http.Server{Addr: listener.Addr().String(), ReadHeaderTimeout: time.Second}); err == nil {
+		t.Fatalf("expected error for port in use, got nil")
+	}
+}
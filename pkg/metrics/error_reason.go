@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	errorReasonKey = "error_reason"
+	// ErrorReasonThrottled is reported when Key Vault or AAD throttled the request.
+	ErrorReasonThrottled = "throttled"
+	// ErrorReasonUnauthorized is reported when the token was missing, expired or rejected.
+	ErrorReasonUnauthorized = "unauthorized"
+	// ErrorReasonForbidden is reported when the identity is not allowed to use the key.
+	ErrorReasonForbidden = "forbidden"
+	// ErrorReasonKeyNotFound is reported when the key or key version does not exist.
+	ErrorReasonKeyNotFound = "key_not_found"
+	// ErrorReasonKeyDisabled is reported when the key is disabled, not yet valid or expired.
+	ErrorReasonKeyDisabled = "key_disabled"
+	// ErrorReasonTimeout is reported when the request timed out.
+	ErrorReasonTimeout = "timeout"
+	// ErrorReasonCanceled is reported when the caller canceled the request.
+	ErrorReasonCanceled = "canceled"
+	// ErrorReasonNetwork is reported when Key Vault or AAD could not be reached.
+	ErrorReasonNetwork = "network"
+	// ErrorReasonServerError is reported when Key Vault or AAD failed with a server error.
+	ErrorReasonServerError = "server_error"
+	// ErrorReasonAnnotationInvalid is reported when the annotations of a kms v2 decrypt request are invalid.
+	ErrorReasonAnnotationInvalid = "annotation_invalid"
+	// ErrorReasonKeyIDMismatch is reported when the key id of a request or response is not the configured key.
+	ErrorReasonKeyIDMismatch = "keyid_mismatch"
+	// ErrorReasonUnknown is reported for all other errors.
+	ErrorReasonUnknown = "unknown"
+)
+
+// ErrorReasoner is implemented by errors that know their reason, so they are classified
+// without inspecting the error message.
+type ErrorReasoner interface {
+	ErrorReason() string
+}
+
+// ErrorReason classifies err into one of a fixed set of reasons, so it can be used as a metric label.
+// The reason is taken from an ErrorReasoner in the chain of err, then from the HTTP status and
+// error code of a Key Vault or AAD response, then from network and context errors.
+// It returns "" for a nil error.
+func ErrorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var reasoner ErrorReasoner
+	if errors.As(err, &reasoner) {
+		return reasoner.ErrorReason()
+	}
+
+	var requestErr *azure.RequestError
+	if errors.As(err, &requestErr) && requestErr.ServiceError != nil {
+		if reason := serviceErrorReason(requestErr.ServiceError); reason != "" {
+			return reason
+		}
+	}
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) {
+		if statusCode, ok := detailedErr.StatusCode.(int); ok {
+			if reason := statusCodeReason(statusCode); reason != "" {
+				return reason
+			}
+		}
+	}
+
+	var refreshErr adal.TokenRefreshError
+	if errors.As(err, &refreshErr) && refreshErr.Response() != nil {
+		if reason := statusCodeReason(refreshErr.Response().StatusCode); reason != "" {
+			return reason
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorReasonTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorReasonCanceled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorReasonTimeout
+		}
+		return ErrorReasonNetwork
+	}
+
+	return ErrorReasonUnknown
+}
+
+// serviceErrorReason classifies the error code of a Key Vault error response.
+// The codes are documented at https://learn.microsoft.com/azure/key-vault/general/rest-error-codes.
+func serviceErrorReason(serviceErr *azure.ServiceError) string {
+	codes := []string{serviceErr.Code}
+	if innerCode, ok := serviceErr.InnerError["code"].(string); ok {
+		codes = append([]string{innerCode}, codes...)
+	}
+	for _, code := range codes {
+		switch strings.ToLower(code) {
+		case "throttled", "toomanyrequests":
+			return ErrorReasonThrottled
+		case "unauthorized":
+			return ErrorReasonUnauthorized
+		case "forbiddenbypolicy", "forbidden", "accessdenied":
+			return ErrorReasonForbidden
+		case "keynotfound":
+			return ErrorReasonKeyNotFound
+		case "keydisabled", "keyexpired", "keynotyetvalid":
+			return ErrorReasonKeyDisabled
+		}
+	}
+	return ""
+}
+
+// statusCodeReason classifies the HTTP status of a Key Vault or AAD response.
+func statusCodeReason(statusCode int) string {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return ErrorReasonThrottled
+	case http.StatusUnauthorized:
+		return ErrorReasonUnauthorized
+	case http.StatusForbidden:
+		return ErrorReasonForbidden
+	case http.StatusNotFound:
+		return ErrorReasonKeyNotFound
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrorReasonTimeout
+	}
+	if statusCode >= http.StatusInternalServerError {
+		return ErrorReasonServerError
+	}
+	return ""
+}
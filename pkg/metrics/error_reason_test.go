@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+type reasonErr struct{}
+
+func (reasonErr) Error() string       { return "invalid annotations" }
+func (reasonErr) ErrorReason() string { return ErrorReasonAnnotationInvalid }
+
+func keyVaultError(statusCode int, code string, innerError map[string]interface{}) error {
+	requestErr := &azure.RequestError{
+		DetailedError: autorest.DetailedError{StatusCode: statusCode},
+		ServiceError:  &azure.ServiceError{Code: code, InnerError: innerError},
+	}
+	return fmt.Errorf("failed to encrypt, error: %w", autorest.NewErrorWithError(requestErr, "keyvault.BaseClient", "Encrypt", &http.Response{StatusCode: statusCode}, "Failure responding to request"))
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected string
+	}{
+		{
+			desc:     "nil error",
+			err:      nil,
+			expected: "",
+		},
+		{
+			desc:     "error with reason",
+			err:      fmt.Errorf("failed to decrypt: %w", reasonErr{}),
+			expected: ErrorReasonAnnotationInvalid,
+		},
+		{
+			desc:     "throttled",
+			err:      keyVaultError(http.StatusTooManyRequests, "Throttled", nil),
+			expected: ErrorReasonThrottled,
+		},
+		{
+			desc:     "unauthorized",
+			err:      keyVaultError(http.StatusUnauthorized, "Unauthorized", nil),
+			expected: ErrorReasonUnauthorized,
+		},
+		{
+			desc:     "forbidden",
+			err:      keyVaultError(http.StatusForbidden, "Forbidden", map[string]interface{}{"code": "ForbiddenByPolicy"}),
+			expected: ErrorReasonForbidden,
+		},
+		{
+			desc:     "key disabled",
+			err:      keyVaultError(http.StatusForbidden, "Forbidden", map[string]interface{}{"code": "KeyDisabled"}),
+			expected: ErrorReasonKeyDisabled,
+		},
+		{
+			desc:     "key not found",
+			err:      keyVaultError(http.StatusNotFound, "KeyNotFound", nil),
+			expected: ErrorReasonKeyNotFound,
+		},
+		{
+			desc:     "status code without error code",
+			err:      autorest.NewErrorWithError(errors.New("failed"), "keyvault.BaseClient", "Decrypt", &http.Response{StatusCode: http.StatusTooManyRequests}, "Failure responding to request"),
+			expected: ErrorReasonThrottled,
+		},
+		{
+			desc:     "server error",
+			err:      keyVaultError(http.StatusServiceUnavailable, "ServiceUnavailable", nil),
+			expected: ErrorReasonServerError,
+		},
+		{
+			desc:     "deadline exceeded",
+			err:      fmt.Errorf("failed to encrypt, error: %w", context.DeadlineExceeded),
+			expected: ErrorReasonTimeout,
+		},
+		{
+			desc:     "canceled",
+			err:      fmt.Errorf("failed to encrypt, error: %w", context.Canceled),
+			expected: ErrorReasonCanceled,
+		},
+		{
+			desc:     "network error",
+			err:      autorest.NewErrorWithError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "keyvault.BaseClient", "Encrypt", nil, "Failure sending request"),
+			expected: ErrorReasonNetwork,
+		},
+		{
+			desc:     "unknown error",
+			err:      errors.New("failed to base64 decode result"),
+			expected: ErrorReasonUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if reason := ErrorReason(test.err); reason != test.expected {
+				t.Fatalf("expected reason: %q, got: %q", test.expected, reason)
+			}
+		})
+	}
+}
@@ -1,26 +1,91 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
+	"time"
 
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"monis.app/mlog"
 )
 
 const (
 	prometheusExporter = "prometheus"
+	otlpExporter       = "otlp"
+
+	// meterProviderShutdownTimeout bounds the last export on shutdown.
+	meterProviderShutdownTimeout = 5 * time.Second
 )
 
-// InitMetricsExporter initializes new exporter.
-func InitMetricsExporter(metricsBackend, metricsAddress string) error {
-	exporter := strings.ToLower(metricsBackend)
-	mlog.Always("metrics backend", "exporter", exporter)
-
-	switch exporter {
-	// Prometheus is the only exporter supported for now
-	case prometheusExporter:
-		return initPrometheusExporter(metricsAddress)
-	default:
-		return fmt.Errorf("unsupported metrics backend %v", metricsBackend)
+// InitMetricsExporter initializes the exporters of metricsBackend, a comma separated list of
+// prometheus and otlp. It returns the server for the prometheus metrics endpoint, which is
+// started by the caller and is nil without the prometheus backend, and a closer that exports
+// the pending metrics and stops the exporters.
+func InitMetricsExporter(metricsBackend, metricsAddress string, otlpConfig OTLPConfig) (*http.Server, io.Closer, error) {
+	var server *http.Server
+	var readers []sdkmetric.Reader
+	seen := map[string]bool{}
+	for _, backend := range strings.Split(metricsBackend, ",") {
+		exporter := strings.ToLower(strings.TrimSpace(backend))
+		if seen[exporter] {
+			return nil, nil, fmt.Errorf("duplicate metrics backend %v", backend)
+		}
+		seen[exporter] = true
+		mlog.Always("metrics backend", "exporter", exporter)
+
+		switch exporter {
+		case prometheusExporter:
+			reader, promServer, err := initPrometheusExporter(metricsAddress)
+			if err != nil {
+				return nil, nil, err
+			}
+			readers = append(readers, reader)
+			server = promServer
+		case otlpExporter:
+			reader, err := initOTLPExporter(context.Background(), otlpConfig)
+			if err != nil {
+				return nil, nil, err
+			}
+			readers = append(readers, reader)
+		default:
+			return nil, nil, fmt.Errorf("unsupported metrics backend %v", backend)
+		}
+	}
+
+	opts := []sdkmetric.Option{
+		sdkmetric.WithView(sdkmetric.NewView(
+			sdkmetric.Instrument{Kind: sdkmetric.InstrumentKindHistogram},
+			sdkmetric.Stream{
+				Aggregation: sdkmetric.AggregationExplicitBucketHistogram{
+					Boundaries: promclient.ExponentialBucketsRange(0.1, 2, 11),
+				},
+			},
+		)),
+	}
+	for _, reader := range readers {
+		opts = append(opts, sdkmetric.WithReader(reader))
+	}
+	mp := sdkmetric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(mp)
+
+	return server, &meterProviderCloser{mp: mp}, nil
+}
+
+// meterProviderCloser exports the pending metrics and stops the exporters on Close.
+type meterProviderCloser struct {
+	mp *sdkmetric.MeterProvider
+}
+
+func (c *meterProviderCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), meterProviderShutdownTimeout)
+	defer cancel()
+	if err := c.mp.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down metrics exporters, error: %w", err)
 	}
+	return nil
 }
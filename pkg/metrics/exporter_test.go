@@ -3,9 +3,12 @@ package metrics
 import (
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestInitMetricsExporter(t *testing.T) {
+	otlpEndpoint := startGRPCReceiver(t, newOTLPReceiver())
+
 	testCases := []struct {
 		name           string
 		metricsBackend string
@@ -29,15 +32,39 @@ func TestInitMetricsExporter(t *testing.T) {
 			metricsAddress: "8096",
 			expectedError:  false,
 		},
+		{
+			name:           "With_Prometheus_And_OTLP_Backends",
+			metricsBackend: "prometheus,otlp",
+			metricsAddress: "8097",
+			expectedError:  false,
+		},
+		{
+			name:           "With_Duplicate_Backends",
+			metricsBackend: "prometheus,Prometheus",
+			expectedError:  true,
+		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			err := InitMetricsExporter(testCase.metricsBackend, testCase.metricsAddress)
+			server, closer, err := InitMetricsExporter(testCase.metricsBackend, testCase.metricsAddress, OTLPConfig{
+				Protocol:       OTLPProtocolGRPC,
+				Endpoint:       otlpEndpoint,
+				Insecure:       true,
+				ExportInterval: time.Minute,
+			})
 
 			if testCase.expectedError && err == nil || !testCase.expectedError && err != nil {
 				t.Fatalf("expected error: %v, found: %v", testCase.expectedError, err)
 			}
+			if !testCase.expectedError && server.Addr != ":"+testCase.metricsAddress {
+				t.Fatalf("expected server address: :%s, found: %s", testCase.metricsAddress, server.Addr)
+			}
+			if closer != nil {
+				if err := closer.Close(); err != nil {
+					t.Fatalf("expected err to be nil, got: %v", err)
+				}
+			}
 
 			// Reset handler to test /metrics  repeatedly.
 			http.DefaultServeMux = new(http.ServeMux)
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	checkKey                            = "check"
+	healthCheckMetricName               = "health_check"
+	healthCheckConsecutiveFailuresName  = "health_check_consecutive_failures"
+	healthCheckLastSuccessTimestampName = "health_check_last_success_timestamp"
+)
+
+type healthReporter struct {
+	histogram           metric.Float64Histogram
+	consecutiveFailures metric.Int64Gauge
+	lastSuccess         metric.Float64Gauge
+}
+
+// HealthStatsReporter reports the results of the checks of the health check endpoint.
+type HealthStatsReporter interface {
+	ReportHealthCheck(ctx context.Context, check, status string, duration float64, consecutiveFailures int, lastSuccess time.Time)
+}
+
+// NewHealthStatsReporter instantiates otel reporter for health checks.
+func NewHealthStatsReporter() (HealthStatsReporter, error) {
+	meter := otel.GetMeterProvider().Meter(instrumentationName)
+
+	histogram, err := meter.Float64Histogram(
+		healthCheckMetricName,
+		metric.WithDescription("Distribution of how long it took for a health check"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	consecutiveFailures, err := meter.Int64Gauge(
+		healthCheckConsecutiveFailuresName,
+		metric.WithDescription("Number of consecutive failures of a health check"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	lastSuccess, err := meter.Float64Gauge(
+		healthCheckLastSuccessTimestampName,
+		metric.WithDescription("Unix time of the last success of a health check"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &healthReporter{
+		histogram:           histogram,
+		consecutiveFailures: consecutiveFailures,
+		lastSuccess:         lastSuccess,
+	}, nil
+}
+
+func (r *healthReporter) ReportHealthCheck(ctx context.Context, check, status string, duration float64, consecutiveFailures int, lastSuccess time.Time) {
+	labels := append(providerLabels(ctx), attribute.String(checkKey, check))
+	r.histogram.Record(ctx, duration, metric.WithAttributes(append(labels, attribute.String(statusTypeKey, status))...))
+	r.consecutiveFailures.Record(ctx, int64(consecutiveFailures), metric.WithAttributes(labels...))
+	if !lastSuccess.IsZero() {
+		r.lastSuccess.Record(ctx, float64(lastSuccess.UnixNano())/float64(time.Second), metric.WithAttributes(labels...))
+	}
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	originKey = "origin"
+	// OriginAPIServer sets origin tag to "apiserver", for requests of kube-apiserver and other clients.
+	OriginAPIServer = "apiserver"
+	// OriginHealthz sets origin tag to "healthz", for the round trips of the health checks.
+	OriginHealthz = "healthz"
+	// OriginStatusProbe sets origin tag to "status-probe", for the round trips of the kms v2 status prober.
+	OriginStatusProbe = "status-probe"
+)
+
+type originContextKey struct{}
+
+// WithOrigin returns a copy of ctx that tags the requests reported with it with origin.
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originContextKey{}, origin)
+}
+
+// Origin returns the origin set by WithOrigin. Requests without origin are from kube-apiserver.
+func Origin(ctx context.Context) string {
+	if origin, ok := ctx.Value(originContextKey{}).(string); ok {
+		return origin
+	}
+	return OriginAPIServer
+}
+
+func originLabel(ctx context.Context) attribute.KeyValue {
+	return attribute.String(originKey, Origin(ctx))
+}
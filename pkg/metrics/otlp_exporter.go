@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc/credentials"
+	"monis.app/mlog"
+)
+
+const (
+	// OTLPProtocolGRPC exports metrics with OTLP over gRPC.
+	OTLPProtocolGRPC = "grpc"
+	// OTLPProtocolHTTP exports metrics with OTLP over HTTP with protobuf payloads.
+	OTLPProtocolHTTP = "http"
+)
+
+// DefaultOTLPEndpoint returns the endpoint of a receiver on localhost at the standard port of
+// protocol: 4317 for OTLP over gRPC and 4318 for OTLP over HTTP.
+func DefaultOTLPEndpoint(protocol string) string {
+	if strings.EqualFold(protocol, OTLPProtocolHTTP) {
+		return "localhost:4318"
+	}
+	return "localhost:4317"
+}
+
+// IsLoopbackEndpoint returns true if the host of endpoint is localhost or a loopback address.
+func IsLoopbackEndpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// OTLPConfig configures the otlp metrics backend, e.g. to push metrics to an OpenTelemetry Collector.
+type OTLPConfig struct {
+	// Protocol is OTLPProtocolGRPC or OTLPProtocolHTTP.
+	Protocol string
+	// Endpoint is the host:port of the receiver.
+	Endpoint string
+	// Headers are sent with every export, e.g. for authentication. The headers of the
+	// OTEL_EXPORTER_OTLP_HEADERS environment variable are sent if it is empty.
+	Headers map[string]string
+	// Insecure disables TLS. Otherwise TLSConfig is used, or the system roots if it is nil.
+	Insecure  bool
+	TLSConfig *tls.Config
+	// ExportInterval is the interval between two exports.
+	ExportInterval time.Duration
+}
+
+func initOTLPExporter(ctx context.Context, config OTLPConfig) (sdkmetric.Reader, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("otlp endpoint is required")
+	}
+	if config.ExportInterval <= 0 {
+		return nil, fmt.Errorf("otlp export interval must be positive, got %s", config.ExportInterval)
+	}
+
+	var exporter sdkmetric.Exporter
+	var err error
+	switch strings.ToLower(config.Protocol) {
+	case OTLPProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(config.Endpoint)}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(config.Headers))
+		}
+		if config.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		} else if config.TLSConfig != nil {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(config.TLSConfig)))
+		}
+		exporter, err = otlpmetricgrpc.New(ctx, opts...)
+	case OTLPProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(config.Endpoint)}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(config.Headers))
+		}
+		if config.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if config.TLSConfig != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(config.TLSConfig))
+		}
+		exporter, err = otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %v", config.Protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp exporter, error: %w", err)
+	}
+
+	mlog.Always("OTLP metrics exporter configured", "protocol", config.Protocol, "endpoint", config.Endpoint, "insecure", config.Insecure, "interval", config.ExportInterval)
+	return sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(config.ExportInterval)), nil
+}
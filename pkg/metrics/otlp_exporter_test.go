@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver records the metric names and headers of the OTLP exports it receives.
+type otlpReceiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+
+	mu      sync.Mutex
+	metrics map[string]bool
+	headers map[string]string
+}
+
+func newOTLPReceiver() *otlpReceiver {
+	return &otlpReceiver{metrics: map[string]bool{}, headers: map[string]string{}}
+}
+
+func (r *otlpReceiver) record(req *colmetricpb.ExportMetricsServiceRequest, header func(string) string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				r.metrics[m.GetName()] = true
+			}
+		}
+	}
+	r.headers["x-api-key"] = header("x-api-key")
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.record(req, func(key string) string { return strings.Join(md.Get(key), ",") })
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exportRequest := &colmetricpb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, exportRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.record(exportRequest, req.Header.Get)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+	_, _ = w.Write(out)
+}
+
+func (r *otlpReceiver) received(metric string) (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics[metric], r.headers["x-api-key"]
+}
+
+func startGRPCReceiver(t *testing.T, receiver *otlpReceiver) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(s, receiver)
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	t.Cleanup(s.Stop)
+	return listener.Addr().String()
+}
+
+func startHTTPReceiver(t *testing.T, receiver *otlpReceiver) string {
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestOTLPExporter(t *testing.T) {
+	tests := []struct {
+		desc       string
+		protocol   string
+		start      func(*testing.T, *otlpReceiver) string
+		headers    map[string]string
+		envHeaders string
+	}{
+		{
+			desc:     "grpc",
+			protocol: OTLPProtocolGRPC,
+			start:    startGRPCReceiver,
+			headers:  map[string]string{"x-api-key": "secret"},
+		},
+		{
+			desc:     "http",
+			protocol: OTLPProtocolHTTP,
+			start:    startHTTPReceiver,
+			headers:  map[string]string{"x-api-key": "secret"},
+		},
+		{
+			desc:       "grpc with headers from the environment",
+			protocol:   OTLPProtocolGRPC,
+			start:      startGRPCReceiver,
+			envHeaders: "x-api-key=secret",
+		},
+		{
+			desc:       "http with headers from the environment",
+			protocol:   OTLPProtocolHTTP,
+			start:      startHTTPReceiver,
+			envHeaders: "x-api-key=secret",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", test.envHeaders)
+			receiver := newOTLPReceiver()
+			endpoint := test.start(t, receiver)
+
+			_, closer, err := InitMetricsExporter("otlp", "", OTLPConfig{
+				Protocol:       test.protocol,
+				Endpoint:       endpoint,
+				Headers:        test.headers,
+				Insecure:       true,
+				ExportInterval: time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			reporter, err := NewStatsReporter()
+			if err != nil {
+				t.Fatalf("failed to create stats reporter: %v", err)
+			}
+			reporter.ReportRequest(context.Background(), EncryptOperationTypeValue, 0.1, nil)
+
+			// close exports the pending metrics
+			if err := closer.Close(); err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			received, apiKey := receiver.received(kmsRequestMetricName)
+			if !received {
+				t.Fatalf("expected %s to be exported", kmsRequestMetricName)
+			}
+			if apiKey != "secret" {
+				t.Fatalf("expected header x-api-key: secret, got: %q", apiKey)
+			}
+		})
+	}
+}
+
+func TestOTLPExporterConfigError(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config OTLPConfig
+	}{
+		{
+			desc:   "missing endpoint",
+			config: OTLPConfig{Protocol: OTLPProtocolGRPC, ExportInterval: time.Minute},
+		},
+		{
+			desc:   "invalid interval",
+			config: OTLPConfig{Protocol: OTLPProtocolGRPC, Endpoint: "localhost:4317"},
+		},
+		{
+			desc:   "unsupported protocol",
+			config: OTLPConfig{Protocol: "udp", Endpoint: "localhost:4317", ExportInterval: time.Minute},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if _, _, err := InitMetricsExporter("otlp", "", test.config); err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestDefaultOTLPEndpoint(t *testing.T) {
+	tests := []struct {
+		protocol string
+		expected string
+	}{
+		{protocol: OTLPProtocolGRPC, expected: "localhost:4317"},
+		{protocol: OTLPProtocolHTTP, expected: "localhost:4318"},
+		{protocol: "HTTP", expected: "localhost:4318"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.protocol, func(t *testing.T) {
+			if endpoint := DefaultOTLPEndpoint(test.protocol); endpoint != test.expected {
+				t.Fatalf("expected endpoint: %s, got: %s", test.expected, endpoint)
+			}
+		})
+	}
+}
+
+func TestIsLoopbackEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected bool
+	}{
+		{endpoint: "localhost:4317", expected: true},
+		{endpoint: "LocalHost:4318", expected: true},
+		{endpoint: "127.0.0.1:4317", expected: true},
+		{endpoint: "[::1]:4317", expected: true},
+		{endpoint: "otel-collector:4317", expected: false},
+		{endpoint: "10.0.0.1:4317", expected: false},
+		{endpoint: "localhost", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			if loopback := IsLoopbackEndpoint(test.endpoint); loopback != test.expected {
+				t.Fatalf("expected loopback: %v, got: %v", test.expected, loopback)
+			}
+		})
+	}
+}
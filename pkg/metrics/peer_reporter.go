@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	uidKey                      = "uid"
+	decisionKey                 = "decision"
+	peerAuthorizationMetricName = "peer_authorization"
+	// AllowedDecisionValue sets decision tag to "allowed".
+	AllowedDecisionValue = "allowed"
+	// DeniedDecisionValue sets decision tag to "denied".
+	DeniedDecisionValue = "denied"
+)
+
+type peerReporter struct {
+	counter metric.Int64Counter
+}
+
+// PeerStatsReporter reports authorization decisions for connections on the unix socket.
+type PeerStatsReporter interface {
+	ReportPeerAuthorization(ctx context.Context, uid uint32, decision string)
+}
+
+// NewPeerStatsReporter instantiates otel reporter for peer authorization.
+func NewPeerStatsReporter() (PeerStatsReporter, error) {
+	meter := otel.GetMeterProvider().Meter(instrumentationName)
+
+	counter, err := meter.Int64Counter(
+		peerAuthorizationMetricName,
+		metric.WithDescription("Number of connections authorized or denied based on the peer credentials"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerReporter{
+		counter: counter,
+	}, nil
+}
+
+func (r *peerReporter) ReportPeerAuthorization(ctx context.Context, uid uint32, decision string) {
+	r.counter.Add(ctx, 1, metric.WithAttributes(append(providerLabels(ctx),
+		attribute.String(uidKey, strconv.FormatUint(uint64(uid), 10)),
+		attribute.String(decisionKey, decision),
+	)...))
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const providerKey = "provider"
+
+type providerContextKey struct{}
+
+// WithProvider returns a copy of ctx that adds the provider tag to the metrics reported with it.
+// It is used when one process hosts multiple KMS providers.
+func WithProvider(ctx context.Context, provider string) context.Context {
+	if provider == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, providerContextKey{}, provider)
+}
+
+// providerLabels returns the provider tag set by WithProvider, if any.
+func providerLabels(ctx context.Context) []attribute.KeyValue {
+	provider, ok := ctx.Value(providerContextKey{}).(string)
+	if !ok {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.String(providerKey, provider)}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	targetTypeKey          = "target"
+	hostKey                = "host"
+	statusCodeKey          = "status_code"
+	proxyRequestMetricName = "proxy_request"
+)
+
+type proxyReporter struct {
+	histogram metric.Float64Histogram
+}
+
+// ProxyStatsReporter reports metrics for requests forwarded by the proxy.
+type ProxyStatsReporter interface {
+	ReportProxyRequest(ctx context.Context, target, host string, statusCode int, duration float64)
+}
+
+// NewProxyStatsReporter instantiates otel reporter for the proxy.
+func NewProxyStatsReporter() (ProxyStatsReporter, error) {
+	meter := otel.GetMeterProvider().Meter(instrumentationName)
+
+	histogram, err := meter.Float64Histogram(
+		proxyRequestMetricName,
+		metric.WithDescription("Distribution of how long it took for the proxy to forward a request"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyReporter{
+		histogram: histogram,
+	}, nil
+}
+
+func (r *proxyReporter) ReportProxyRequest(ctx context.Context, target, host string, statusCode int, duration float64) {
+	r.histogram.Record(ctx, duration, metric.WithAttributes(
+		attribute.String(targetTypeKey, target),
+		attribute.String(hostKey, host),
+		attribute.String(statusCodeKey, strconv.Itoa(statusCode)),
+	))
+}
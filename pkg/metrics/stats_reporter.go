@@ -10,7 +10,6 @@ import (
 
 const (
 	instrumentationName  = "keyvaultkms"
-	errorMessageKey      = "error_message"
 	statusTypeKey        = "status"
 	operationTypeKey     = "operation"
 	kmsRequestMetricName = "kms_request"
@@ -32,7 +31,9 @@ type reporter struct {
 
 // StatsReporter reports metrics.
 type StatsReporter interface {
-	ReportRequest(ctx context.Context, operationType, status string, duration float64, errors ...string)
+	// ReportRequest records the duration of an operation. A non-nil err sets the status to error
+	// and adds the reason of err, see ErrorReason.
+	ReportRequest(ctx context.Context, operationType string, duration float64, err error)
 }
 
 // NewStatsReporter instantiates otel reporter.
@@ -52,17 +53,18 @@ func NewStatsReporter() (StatsReporter, error) {
 	}, nil
 }
 
-func (r *reporter) ReportRequest(ctx context.Context, operationType, status string, duration float64, errors ...string) {
-	labels := []attribute.KeyValue{
+func (r *reporter) ReportRequest(ctx context.Context, operationType string, duration float64, err error) {
+	status := SuccessStatusTypeValue
+	if err != nil {
+		status = ErrorStatusTypeValue
+	}
+	labels := append(providerLabels(ctx),
+		originLabel(ctx),
 		attribute.String(operationTypeKey, operationType),
 		attribute.String(statusTypeKey, status),
-	}
-
-	// Add errors
-	if (status == ErrorStatusTypeValue) && len(errors) > 0 {
-		for _, err := range errors {
-			labels = append(labels, attribute.String(errorMessageKey, err))
-		}
+	)
+	if err != nil {
+		labels = append(labels, attribute.String(errorReasonKey, ErrorReason(err)))
 	}
 
 	r.histogram.Record(ctx, duration, metric.WithAttributes(labels...))
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	regionKey                 = "region"
+	directionKey              = "direction"
+	sentDirectionValue        = "sent"
+	receivedDirectionValue    = "received"
+	upstreamRequestMetricName = "upstream_request"
+	upstreamRetryMetricName   = "upstream_request_retries"
+	upstreamBytesMetricName   = "upstream_request_bytes"
+)
+
+// UpstreamRequest is a request sent by the plugin to Key Vault or AAD. Each attempt of a request
+// retried by the client is reported separately.
+type UpstreamRequest struct {
+	// Target is consts.TargetTypeKeyVault or consts.TargetTypeAzureActiveDirectory.
+	Target string
+	// Host is the host the request was sent to.
+	Host string
+	// Region is the x-ms-keyvault-region header of the response, empty for AAD.
+	Region string
+	// StatusCode is the HTTP status of the response, 0 if no response was received.
+	StatusCode int
+	// Retry is set for every attempt but the first.
+	Retry bool
+	// SentBytes is the number of bytes read from the request body until the response was received.
+	SentBytes int64
+	// Duration is the time until the response headers were received.
+	Duration float64
+}
+
+type upstreamReporter struct {
+	histogram metric.Float64Histogram
+	retries   metric.Int64Counter
+	bytes     metric.Int64Counter
+}
+
+// UpstreamStatsReporter reports metrics for the requests sent to Key Vault and AAD.
+type UpstreamStatsReporter interface {
+	ReportUpstreamRequest(ctx context.Context, req UpstreamRequest)
+	// ReportUpstreamReceivedBytes reports the bytes read from the response body of req, once it is closed.
+	ReportUpstreamReceivedBytes(ctx context.Context, req UpstreamRequest, n int64)
+}
+
+// NewUpstreamStatsReporter instantiates otel reporter for the requests sent to Key Vault and AAD.
+func NewUpstreamStatsReporter() (UpstreamStatsReporter, error) {
+	meter := otel.GetMeterProvider().Meter(instrumentationName)
+
+	histogram, err := meter.Float64Histogram(
+		upstreamRequestMetricName,
+		metric.WithDescription("Distribution of how long it took for Key Vault or AAD to respond to a request"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := meter.Int64Counter(
+		upstreamRetryMetricName,
+		metric.WithDescription("Number of retried requests to Key Vault or AAD"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := meter.Int64Counter(
+		upstreamBytesMetricName,
+		metric.WithDescription("Number of bytes sent to and received from Key Vault or AAD"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamReporter{
+		histogram: histogram,
+		retries:   retries,
+		bytes:     bytes,
+	}, nil
+}
+
+func upstreamLabels(ctx context.Context, req UpstreamRequest) []attribute.KeyValue {
+	return append(providerLabels(ctx),
+		originLabel(ctx),
+		attribute.String(targetTypeKey, req.Target),
+		attribute.String(hostKey, req.Host),
+		attribute.String(regionKey, req.Region),
+	)
+}
+
+func (r *upstreamReporter) ReportUpstreamRequest(ctx context.Context, req UpstreamRequest) {
+	labels := upstreamLabels(ctx, req)
+
+	r.histogram.Record(ctx, req.Duration, metric.WithAttributes(append(labels, attribute.String(statusCodeKey, strconv.Itoa(req.StatusCode)))...))
+	if req.Retry {
+		r.retries.Add(ctx, 1, metric.WithAttributes(labels...))
+	}
+	if req.SentBytes > 0 {
+		r.bytes.Add(ctx, req.SentBytes, metric.WithAttributes(append(labels, attribute.String(directionKey, sentDirectionValue))...))
+	}
+}
+
+func (r *upstreamReporter) ReportUpstreamReceivedBytes(ctx context.Context, req UpstreamRequest, n int64) {
+	if n > 0 {
+		r.bytes.Add(ctx, n, metric.WithAttributes(append(upstreamLabels(ctx, req), attribute.String(directionKey, receivedDirectionValue))...))
+	}
+}
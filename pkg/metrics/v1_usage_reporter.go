@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	kmsV1DecryptMetricName = "kms_v1_decrypt"
+)
+
+type v1UsageReporter struct {
+	counter metric.Int64Counter
+}
+
+// V1UsageReporter reports the decrypt requests of kube-apiserver on the deprecated kms v1 API.
+type V1UsageReporter interface {
+	ReportV1Decrypt(ctx context.Context, status string)
+}
+
+// NewV1UsageReporter instantiates otel reporter for kms v1 usage.
+func NewV1UsageReporter() (V1UsageReporter, error) {
+	meter := otel.GetMeterProvider().Meter(instrumentationName)
+
+	counter, err := meter.Int64Counter(
+		kmsV1DecryptMetricName,
+		metric.WithDescription("Number of decrypt requests on the kms v1 API, excluding health checks"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1UsageReporter{
+		counter: counter,
+	}, nil
+}
+
+func (r *v1UsageReporter) ReportV1Decrypt(ctx context.Context, status string) {
+	r.counter.Add(ctx, 1, metric.WithAttributes(append(providerLabels(ctx),
+		attribute.String(statusTypeKey, status),
+	)...))
+}
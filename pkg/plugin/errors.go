@@ -0,0 +1,151 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorInfoDomain is the domain of the ErrorInfo details of the errors returned over gRPC.
+const errorInfoDomain = "azure.akv.io"
+
+// Error is a class of errors of the plugin. The errors returned by the Key Vault client and the
+// kms servers match one of the Err* values with errors.Is, and are returned over gRPC with the
+// code of the class and an ErrorInfo that carries the reason and the Key Vault request id.
+type Error struct {
+	reason string
+	code   codes.Code
+}
+
+var (
+	// ErrKeyIDMismatch is returned when the key id of a request or of the encryption result is not the configured key.
+	ErrKeyIDMismatch = &Error{reason: metrics.ErrorReasonKeyIDMismatch, code: codes.InvalidArgument}
+	// ErrInvalidAnnotations is returned when the annotations of a kms v2 decrypt request are invalid.
+	ErrInvalidAnnotations = &Error{reason: metrics.ErrorReasonAnnotationInvalid, code: codes.InvalidArgument}
+	// ErrThrottled is returned when Key Vault or AAD throttled the request. The request can be retried after a backoff.
+	ErrThrottled = &Error{reason: metrics.ErrorReasonThrottled, code: codes.ResourceExhausted}
+	// ErrUnauthorized is returned when Key Vault rejected the token of the plugin or no token could be acquired.
+	ErrUnauthorized = &Error{reason: metrics.ErrorReasonUnauthorized, code: codes.PermissionDenied}
+	// ErrForbidden is returned when the identity of the plugin is not allowed to use the key.
+	ErrForbidden = &Error{reason: metrics.ErrorReasonForbidden, code: codes.PermissionDenied}
+	// ErrKeyNotFound is returned when the key or key version does not exist.
+	ErrKeyNotFound = &Error{reason: metrics.ErrorReasonKeyNotFound, code: codes.FailedPrecondition}
+	// ErrKeyDisabled is returned when the key is disabled, not yet valid or expired.
+	ErrKeyDisabled = &Error{reason: metrics.ErrorReasonKeyDisabled, code: codes.FailedPrecondition}
+	// ErrTimeout is returned when a request to Key Vault or AAD timed out.
+	ErrTimeout = &Error{reason: metrics.ErrorReasonTimeout, code: codes.DeadlineExceeded}
+	// ErrCanceled is returned when the caller canceled the request.
+	ErrCanceled = &Error{reason: metrics.ErrorReasonCanceled, code: codes.Canceled}
+	// ErrUnavailable is returned when Key Vault or AAD could not be reached or failed with a server error.
+	ErrUnavailable = &Error{reason: metrics.ErrorReasonNetwork, code: codes.Unavailable}
+
+	errorsByReason = map[string]*Error{
+		metrics.ErrorReasonKeyIDMismatch:     ErrKeyIDMismatch,
+		metrics.ErrorReasonAnnotationInvalid: ErrInvalidAnnotations,
+		metrics.ErrorReasonThrottled:         ErrThrottled,
+		metrics.ErrorReasonUnauthorized:      ErrUnauthorized,
+		metrics.ErrorReasonForbidden:         ErrForbidden,
+		metrics.ErrorReasonKeyNotFound:       ErrKeyNotFound,
+		metrics.ErrorReasonKeyDisabled:       ErrKeyDisabled,
+		metrics.ErrorReasonTimeout:           ErrTimeout,
+		metrics.ErrorReasonCanceled:          ErrCanceled,
+		metrics.ErrorReasonNetwork:           ErrUnavailable,
+		metrics.ErrorReasonServerError:       ErrUnavailable,
+	}
+)
+
+func (e *Error) Error() string {
+	return strings.ReplaceAll(e.reason, "_", " ")
+}
+
+// ErrorReason implements metrics.ErrorReasoner.
+func (e *Error) ErrorReason() string {
+	return e.reason
+}
+
+// GRPCStatus returns the status of the class, for errors that wrap it with fmt.Errorf.
+func (e *Error) GRPCStatus() *status.Status {
+	return errorStatus(e.code, e.reason, e.Error(), "")
+}
+
+// kmsError is an error of the plugin with its class, its reason and the Key Vault request id.
+// The reason is more specific than the class for some errors, e.g. a server error is unavailable.
+// The class is nil for errors that could not be classified.
+type kmsError struct {
+	class     *Error
+	reason    string
+	err       error
+	requestID string
+}
+
+// newError returns err with its class. resp is the Key Vault response that failed, it may be nil.
+func newError(class *Error, err error, resp *http.Response) error {
+	return newErrorWithReason(class, class.reason, err, resp)
+}
+
+// classifyError returns err with the class derived from the HTTP status and error code of the
+// Key Vault or AAD response.
+func classifyError(err error, resp *http.Response) error {
+	reason := metrics.ErrorReason(err)
+	return newErrorWithReason(errorsByReason[reason], reason, err, resp)
+}
+
+func newErrorWithReason(class *Error, reason string, err error, resp *http.Response) error {
+	e := &kmsError{class: class, reason: reason, err: err}
+	if resp != nil {
+		e.requestID = resp.Header.Get(requestIDAnnotationValue)
+	}
+	return e
+}
+
+func (e *kmsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kmsError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is the class of e.
+func (e *kmsError) Is(target error) bool {
+	return e.class != nil && target == e.class
+}
+
+// ErrorReason implements metrics.ErrorReasoner.
+func (e *kmsError) ErrorReason() string {
+	return e.reason
+}
+
+// GRPCStatus returns the status sent to the client, so kube-apiserver can tell transient from permanent errors.
+func (e *kmsError) GRPCStatus() *status.Status {
+	code := codes.Unknown
+	if e.class != nil {
+		code = e.class.code
+	}
+	return errorStatus(code, e.reason, e.Error(), e.requestID)
+}
+
+func errorStatus(code codes.Code, reason, msg, requestID string) *status.Status {
+	st := status.New(code, msg)
+	info := &errdetails.ErrorInfo{
+		Reason: strings.ToUpper(reason),
+		Domain: errorInfoDomain,
+	}
+	if requestID != "" {
+		info.Metadata = map[string]string{"requestId": requestID}
+	}
+	if withDetails, err := st.WithDetails(info); err == nil {
+		return withDetails
+	}
+	return st
+}
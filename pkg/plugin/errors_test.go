@@ -0,0 +1,168 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kmsv2 "k8s.io/kms/apis/v2"
+)
+
+func keyVaultResponse(statusCode int, requestID string) *http.Response {
+	resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+	resp.Header.Set(requestIDAnnotationValue, requestID)
+	return resp
+}
+
+func keyVaultError(resp *http.Response, code, innerCode string) error {
+	requestErr := &azure.RequestError{
+		DetailedError: autorest.DetailedError{StatusCode: resp.StatusCode},
+		ServiceError:  &azure.ServiceError{Code: code, InnerError: map[string]interface{}{"code": innerCode}},
+	}
+	err := autorest.NewErrorWithError(requestErr, "keyvault.BaseClient", "Encrypt", resp, "Failure responding to request")
+	return classifyError(fmt.Errorf("failed to encrypt, error: %w", err), resp)
+}
+
+func errorInfo(t *testing.T, err error) *errdetails.ErrorInfo {
+	t.Helper()
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	t.Fatalf("expected error info in status of %v", err)
+	return nil
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		desc              string
+		err               error
+		expectedErr       error
+		expectedCode      codes.Code
+		expectedReason    string
+		expectedRequestID string
+	}{
+		{
+			desc:              "throttled",
+			err:               keyVaultError(keyVaultResponse(http.StatusTooManyRequests, "request-1"), "Throttled", ""),
+			expectedErr:       ErrThrottled,
+			expectedCode:      codes.ResourceExhausted,
+			expectedReason:    "THROTTLED",
+			expectedRequestID: "request-1",
+		},
+		{
+			desc:              "unauthorized",
+			err:               keyVaultError(keyVaultResponse(http.StatusUnauthorized, "request-2"), "Unauthorized", ""),
+			expectedErr:       ErrUnauthorized,
+			expectedCode:      codes.PermissionDenied,
+			expectedReason:    "UNAUTHORIZED",
+			expectedRequestID: "request-2",
+		},
+		{
+			desc:              "key disabled",
+			err:               keyVaultError(keyVaultResponse(http.StatusForbidden, "request-3"), "Forbidden", "KeyDisabled"),
+			expectedErr:       ErrKeyDisabled,
+			expectedCode:      codes.FailedPrecondition,
+			expectedReason:    "KEY_DISABLED",
+			expectedRequestID: "request-3",
+		},
+		{
+			desc:              "server error",
+			err:               keyVaultError(keyVaultResponse(http.StatusServiceUnavailable, "request-4"), "ServiceUnavailable", ""),
+			expectedErr:       ErrUnavailable,
+			expectedCode:      codes.Unavailable,
+			expectedReason:    "SERVER_ERROR",
+			expectedRequestID: "request-4",
+		},
+		{
+			desc:           "network",
+			err:            classifyError(autorest.NewErrorWithError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "keyvault.BaseClient", "Encrypt", nil, "Failure sending request"), nil),
+			expectedErr:    ErrUnavailable,
+			expectedCode:   codes.Unavailable,
+			expectedReason: "NETWORK",
+		},
+		{
+			desc:           "invalid annotations",
+			err:            newError(ErrInvalidAnnotations, errors.New("invalid annotations, annotations cannot be empty"), nil),
+			expectedErr:    ErrInvalidAnnotations,
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: "ANNOTATION_INVALID",
+		},
+		{
+			desc:           "wrapped class",
+			err:            fmt.Errorf("failed to decrypt: %w", ErrKeyIDMismatch),
+			expectedErr:    ErrKeyIDMismatch,
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: "KEYID_MISMATCH",
+		},
+		{
+			desc:              "unknown",
+			err:               classifyError(errors.New("failed to base64 decode result"), keyVaultResponse(http.StatusOK, "request-5")),
+			expectedCode:      codes.Unknown,
+			expectedReason:    "UNKNOWN",
+			expectedRequestID: "request-5",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if test.expectedErr != nil && !errors.Is(test.err, test.expectedErr) {
+				t.Fatalf("expected %v to be %v", test.err, test.expectedErr)
+			}
+			if errors.Is(test.err, ErrKeyNotFound) {
+				t.Fatalf("expected %v not to be %v", test.err, ErrKeyNotFound)
+			}
+			if code := status.Code(test.err); code != test.expectedCode {
+				t.Fatalf("expected code: %v, got: %v", test.expectedCode, code)
+			}
+			info := errorInfo(t, test.err)
+			if info.Reason != test.expectedReason {
+				t.Fatalf("expected reason: %s, got: %s", test.expectedReason, info.Reason)
+			}
+			if requestID := info.Metadata["requestId"]; requestID != test.expectedRequestID {
+				t.Fatalf("expected request id: %q, got: %q", test.expectedRequestID, requestID)
+			}
+		})
+	}
+}
+
+func TestErrorOverGRPC(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	_, _, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	mockKVClient.SetEncryptResponse(nil, keyVaultError(keyVaultResponse(http.StatusTooManyRequests, "request-1"), "Throttled", ""))
+
+	healthz := &HealthZ{UnixSocketPath: socketPath}
+	conn, err := healthz.dial()
+	if err != nil {
+		t.Fatalf("failed to create connection, err: %+v", err)
+	}
+	defer conn.Close()
+
+	_, err = kmsv2.NewKeyManagementServiceClient(conn).Encrypt(context.Background(), &kmsv2.EncryptRequest{Plaintext: []byte("foo")})
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("expected code: %v, got: %v", codes.ResourceExhausted, code)
+	}
+	if requestID := errorInfo(t, err).Metadata["requestId"]; requestID != "request-1" {
+		t.Fatalf("expected request id: %q, got: %q", "request-1", requestID)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	kmsv1 "k8s.io/kms/apis/v1beta1"
+	kmsv2 "k8s.io/kms/apis/v2"
+	"monis.app/mlog"
+)
+
+const (
+	// KMSv1ServiceName is the name of the kms v1 service in the grpc.health.v1 service.
+	KMSv1ServiceName = "v1beta1.KeyManagementService"
+	// KMSv2ServiceName is the name of the kms v2 service in the grpc.health.v1 service.
+	KMSv2ServiceName = "v2.KeyManagementService"
+)
+
+// GRPCHealth serves the standard grpc.health.v1 service on the KMS gRPC server.
+// The status of each kms service is set every Interval from the latest probe of the kms v2
+// status prober, or, without status prober, by encrypting and decrypting test data with
+// Key Vault. The overall status, with an empty service name, is SERVING only if all enabled
+// kms services are serving. A nil KMSv1Server or KMSv2Server is not registered, as that
+// version is disabled.
+type GRPCHealth struct {
+	KMSv1Server *KeyManagementServiceServer
+	KMSv2Server *KeyManagementServiceV2Server
+	// Interval is the time between two checks. 0 disables the checks, and all services are
+	// SERVING until shutdown.
+	Interval   time.Duration
+	RPCTimeout time.Duration
+	// Provider tags the metrics of the checks when one process hosts multiple KMS providers.
+	Provider string
+
+	server *health.Server
+}
+
+// Register registers the grpc.health.v1 service on s. All services are NOT_SERVING until the first check.
+func (h *GRPCHealth) Register(s *grpc.Server) {
+	h.server = health.NewServer()
+	for _, service := range h.services() {
+		h.server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	healthpb.RegisterHealthServer(s, h.server)
+}
+
+// services returns the overall service and the enabled kms services.
+func (h *GRPCHealth) services() []string {
+	services := []string{""}
+	if h.KMSv1Server != nil {
+		services = append(services, KMSv1ServiceName)
+	}
+	if h.KMSv2Server != nil {
+		services = append(services, KMSv2ServiceName)
+	}
+	return services
+}
+
+// Run checks the kms services every Interval until ctx is done.
+func (h *GRPCHealth) Run(ctx context.Context) {
+	if h.Interval <= 0 {
+		for _, service := range h.services() {
+			h.server.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+		}
+		return
+	}
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown sets all services to NOT_SERVING and ignores later checks,
+// so clients watching the status see the shutdown before requests are drained.
+func (h *GRPCHealth) Shutdown() {
+	h.server.Shutdown()
+}
+
+func (h *GRPCHealth) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(metrics.WithProvider(ctx, h.Provider), h.RPCTimeout)
+	defer cancel()
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if h.KMSv2Server != nil && h.KMSv2Server.hasStatusProber() {
+		// the status prober already checks Key Vault, so no other round trip is made. Both kms
+		// versions encrypt with the same Key Vault client, so the probe also sets the kms v1 status.
+		err := h.KMSv2Server.latestStatusProbeError()
+		for _, service := range h.services()[1:] {
+			status = h.setServingStatus(service, err)
+		}
+		h.server.SetServingStatus("", status)
+		return
+	}
+	if h.KMSv1Server != nil {
+		if h.setServingStatus(KMSv1ServiceName, checkKMSv1(ctx, kmsV1LocalClient{h.KMSv1Server})) != healthpb.HealthCheckResponse_SERVING {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	if h.KMSv2Server != nil {
+		if h.setServingStatus(KMSv2ServiceName, checkKMSv2(ctx, kmsV2LocalClient{h.KMSv2Server})) != healthpb.HealthCheckResponse_SERVING {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	h.server.SetServingStatus("", status)
+}
+
+func (h *GRPCHealth) setServingStatus(service string, err error) healthpb.HealthCheckResponse_ServingStatus {
+	if err != nil {
+		mlog.Error("grpc health check failed", err, "service", service, "provider", h.Provider)
+		h.server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	mlog.Trace("grpc health check succeeded", "service", service, "provider", h.Provider)
+	h.server.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+// kmsV1LocalClient calls the kms v1 server in-process. The grpc.health.v1 service is served by
+// the same gRPC server, so its checks do not need to go through the socket.
+type kmsV1LocalClient struct {
+	s *KeyManagementServiceServer
+}
+
+func (c kmsV1LocalClient) Version(ctx context.Context, in *kmsv1.VersionRequest, _ ...grpc.CallOption) (*kmsv1.VersionResponse, error) {
+	return c.s.Version(ctx, in)
+}
+
+func (c kmsV1LocalClient) Encrypt(ctx context.Context, in *kmsv1.EncryptRequest, _ ...grpc.CallOption) (*kmsv1.EncryptResponse, error) {
+	return c.s.Encrypt(ctx, in)
+}
+
+func (c kmsV1LocalClient) Decrypt(ctx context.Context, in *kmsv1.DecryptRequest, _ ...grpc.CallOption) (*kmsv1.DecryptResponse, error) {
+	return c.s.Decrypt(ctx, in)
+}
+
+// kmsV2LocalClient calls the kms v2 server in-process.
+type kmsV2LocalClient struct {
+	s *KeyManagementServiceV2Server
+}
+
+func (c kmsV2LocalClient) Status(ctx context.Context, in *kmsv2.StatusRequest, _ ...grpc.CallOption) (*kmsv2.StatusResponse, error) {
+	return c.s.Status(ctx, in)
+}
+
+func (c kmsV2LocalClient) Encrypt(ctx context.Context, in *kmsv2.EncryptRequest, _ ...grpc.CallOption) (*kmsv2.EncryptResponse, error) {
+	return c.s.Encrypt(ctx, in)
+}
+
+func (c kmsV2LocalClient) Decrypt(ctx context.Context, in *kmsv2.DecryptRequest, _ ...grpc.CallOption) (*kmsv2.DecryptResponse, error) {
+	return c.s.Decrypt(ctx, in)
+}
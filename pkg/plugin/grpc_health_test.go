@@ -0,0 +1,212 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+	mockkeyvault "github.com/Azure/kubernetes-kms/pkg/plugin/mock_keyvault"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCHealthCheck(t *testing.T) {
+	tests := []struct {
+		desc               string
+		setEncryptResponse string
+		setDecryptResponse string
+		setEncryptError    error
+		expectedStatus     healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{
+			desc:            "failed to encrypt",
+			setEncryptError: fmt.Errorf("failed to encrypt"),
+			expectedStatus:  healthpb.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			desc:               "encrypt-decrypt mismatch",
+			setEncryptResponse: "bar",
+			setDecryptResponse: "foo",
+			expectedStatus:     healthpb.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			desc:               "successful health check",
+			setEncryptResponse: "bar",
+			setDecryptResponse: healthCheckPlainText,
+			expectedStatus:     healthpb.HealthCheckResponse_SERVING,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			statsReporter, err := metrics.NewStatsReporter()
+			if err != nil {
+				t.Fatalf("failed to create stats reporter: %v", err)
+			}
+			kvClient := &mockkeyvault.KeyVaultClient{
+				KeyID:     "mock-key-id",
+				Algorithm: keyvault.RSA15,
+			}
+			kvClient.SetEncryptResponse([]byte(test.setEncryptResponse), test.setEncryptError)
+			kvClient.SetDecryptResponse([]byte(test.setDecryptResponse), nil)
+
+			h := &GRPCHealth{
+				KMSv1Server: &KeyManagementServiceServer{kvClient: kvClient, reporter: statsReporter},
+				KMSv2Server: &KeyManagementServiceV2Server{kvClient: kvClient, reporter: statsReporter},
+				Interval:    time.Minute,
+				RPCTimeout:  20 * time.Second,
+			}
+			h.Register(grpc.NewServer())
+
+			for _, service := range []string{"", KMSv1ServiceName, KMSv2ServiceName} {
+				resp, err := h.server.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil {
+					t.Fatalf("expected err to be nil, got: %v", err)
+				}
+				if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+					t.Fatalf("expected service %q to be NOT_SERVING before the first check, got: %v", service, resp.Status)
+				}
+			}
+
+			h.check(context.TODO())
+
+			for _, service := range []string{"", KMSv1ServiceName, KMSv2ServiceName} {
+				resp, err := h.server.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil {
+					t.Fatalf("expected err to be nil, got: %v", err)
+				}
+				if resp.Status != test.expectedStatus {
+					t.Fatalf("expected service %q status: %v, got: %v", service, test.expectedStatus, resp.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCHealthCheckKMSv1Disabled(t *testing.T) {
+	statsReporter, err := metrics.NewStatsReporter()
+	if err != nil {
+		t.Fatalf("failed to create stats reporter: %v", err)
+	}
+	kvClient := &mockkeyvault.KeyVaultClient{
+		KeyID:     "mock-key-id",
+		Algorithm: keyvault.RSA15,
+	}
+	kvClient.SetEncryptResponse([]byte("bar"), nil)
+	kvClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+
+	h := &GRPCHealth{
+		KMSv2Server: &KeyManagementServiceV2Server{kvClient: kvClient, reporter: statsReporter},
+		Interval:    time.Minute,
+		RPCTimeout:  20 * time.Second,
+	}
+	h.Register(grpc.NewServer())
+	h.check(context.TODO())
+
+	for _, service := range []string{"", KMSv2ServiceName} {
+		resp, err := h.server.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("expected service %q to be SERVING, got: %v", service, resp.Status)
+		}
+	}
+	if _, err := h.server.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: KMSv1ServiceName}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected code %v for disabled kms v1, got: %v", codes.NotFound, err)
+	}
+}
+
+func TestGRPCHealthCheckFromStatusProber(t *testing.T) {
+	tests := []struct {
+		desc           string
+		probe          *statusProbe
+		expectedStatus healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{
+			desc:           "successful probe",
+			probe:          &statusProbe{time: time.Now()},
+			expectedStatus: healthpb.HealthCheckResponse_SERVING,
+		},
+		{
+			desc:           "failed probe",
+			probe:          &statusProbe{reason: "encrypt: throttled", err: fmt.Errorf("failed to encrypt"), time: time.Now()},
+			expectedStatus: healthpb.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			desc:           "stale probe",
+			probe:          &statusProbe{time: time.Now().Add(-time.Hour)},
+			expectedStatus: healthpb.HealthCheckResponse_NOT_SERVING,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			kvClient := &mockkeyvault.KeyVaultClient{KeyID: "mock-key-id"}
+			kvClient.SetEncryptResponse([]byte("bar"), nil)
+			kvClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+			kmsV2Server := &KeyManagementServiceV2Server{
+				kvClient:    kvClient,
+				statusCache: &statusCache{maxStaleness: time.Minute, probe: test.probe},
+			}
+
+			h := &GRPCHealth{
+				KMSv1Server: &KeyManagementServiceServer{kvClient: kvClient},
+				KMSv2Server: kmsV2Server,
+				Interval:    time.Minute,
+				RPCTimeout:  20 * time.Second,
+			}
+			h.Register(grpc.NewServer())
+			h.check(context.TODO())
+
+			for _, service := range []string{"", KMSv1ServiceName, KMSv2ServiceName} {
+				resp, err := h.server.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil {
+					t.Fatalf("expected err to be nil, got: %v", err)
+				}
+				if resp.Status != test.expectedStatus {
+					t.Fatalf("expected service %q status: %v, got: %v", service, test.expectedStatus, resp.Status)
+				}
+			}
+			// the status is taken from the probe without calling key vault
+			if calls := kvClient.EncryptCalls(); calls != 0 {
+				t.Fatalf("expected no encrypt calls, got: %d", calls)
+			}
+		})
+	}
+}
+
+func TestGRPCHealthRunDisabled(t *testing.T) {
+	kvClient := &mockkeyvault.KeyVaultClient{KeyID: "mock-key-id"}
+	h := &GRPCHealth{
+		KMSv2Server: &KeyManagementServiceV2Server{kvClient: kvClient},
+		RPCTimeout:  20 * time.Second,
+	}
+	h.Register(grpc.NewServer())
+	// Run returns right away when the checks are disabled
+	h.Run(context.TODO())
+
+	for _, service := range []string{"", KMSv2ServiceName} {
+		resp, err := h.server.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("expected service %q to be SERVING, got: %v", service, resp.Status)
+		}
+	}
+	if calls := kvClient.EncryptCalls(); calls != 0 {
+		t.Fatalf("expected no encrypt calls, got: %d", calls)
+	}
+}
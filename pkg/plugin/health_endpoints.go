@@ -0,0 +1,214 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+	"github.com/Azure/kubernetes-kms/pkg/version"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	kmsv1 "k8s.io/kms/apis/v1beta1"
+	"monis.app/mlog"
+)
+
+// healthCheck is a named check served on /livez or /readyz.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readiness caches the result of the Key Vault checks of a provider, so readiness probes
+// do not call Key Vault on every hit and a single failed check does not fail readiness.
+type readiness struct {
+	mu                  sync.Mutex
+	checked             time.Time
+	succeeded           bool
+	err                 error
+	consecutiveFailures int
+}
+
+// livezChecks returns the checks that the process and the gRPC server of every provider respond.
+// They do not call Key Vault, so a Key Vault outage does not restart the plugin.
+func livezChecks(healthz []*HealthZ) []healthCheck {
+	checks := []healthCheck{{name: "ping", check: func(context.Context) error { return nil }}}
+	for _, h := range healthz {
+		checks = append(checks, healthCheck{name: checkName(h.Provider, "socket"), check: h.checkLive})
+	}
+	return checks
+}
+
+// readyzChecks returns the livez checks, a shutdown check, and the cached Key Vault check of every provider.
+func readyzChecks(healthz []*HealthZ) []healthCheck {
+	checks := livezChecks(healthz)
+	checks = append(checks, healthCheck{name: "shutdown", check: func(context.Context) error {
+		for _, h := range healthz {
+			if h.shuttingDown.Load() {
+				return fmt.Errorf("shutting down")
+			}
+		}
+		return nil
+	}})
+	for _, h := range healthz {
+		checks = append(checks, healthCheck{name: checkName(h.Provider, "keyvault"), check: h.checkReady})
+	}
+	return checks
+}
+
+func checkName(provider, check string) string {
+	if provider == "" {
+		return check
+	}
+	return provider + "/" + check
+}
+
+// healthChecksHandler serves checks like the health endpoints of kube-apiserver: "ok" when all
+// checks pass, and one line per check when a check fails or the verbose query parameter is set.
+func healthChecksHandler(endpoint string, checks []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, verbose := r.URL.Query()["verbose"]
+
+		var out bytes.Buffer
+		failed := false
+		for _, c := range checks {
+			if err := c.check(r.Context()); err != nil {
+				mlog.Info("health check failed", "endpoint", endpoint, "check", c.name, "error", err)
+				fmt.Fprintf(&out, "[-]%s failed: %v\n", c.name, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(&out, "[+]%s ok\n", c.name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			fmt.Fprintf(&out, "%s check failed\n", endpoint)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(out.Bytes())
+			return
+		}
+		if !verbose {
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		fmt.Fprintf(&out, "%s check passed\n", endpoint)
+		_, _ = w.Write(out.Bytes())
+	}
+}
+
+// checkLive checks that the gRPC server of the provider responds on its socket. It never calls
+// Key Vault, so a slow or degraded Key Vault does not fail liveness and restart the plugin.
+func (h *HealthZ) checkLive(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(metrics.WithProvider(ctx, h.Provider), h.RPCTimeout)
+	defer cancel()
+
+	conn, err := h.connection()
+	if err != nil {
+		return err
+	}
+
+	if h.KMSv1Server != nil {
+		v, err := kmsv1.NewKeyManagementServiceClient(conn).Version(ctx, &kmsv1.VersionRequest{})
+		if err != nil {
+			return err
+		}
+		if v.Version != version.KMSv1APIVersion {
+			return fmt.Errorf("failed to get correct version response")
+		}
+		return nil
+	}
+	// kms v2 Status can probe Key Vault, so the grpc.health.v1 service is called instead. Its
+	// status is set by the Key Vault checks, so only the error of the call is checked.
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkReady checks Key Vault through the enabled kms servers at most once per ReadyzCacheTTL.
+// The provider is not ready until a check succeeded, and after ReadyzFailureThreshold checks in a row failed.
+func (h *HealthZ) checkReady(ctx context.Context) error {
+	r := &h.readiness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.checked.IsZero() || time.Since(r.checked) >= h.ReadyzCacheTTL {
+		r.err = h.checkBackend(ctx)
+		r.checked = time.Now()
+		if r.err != nil {
+			r.consecutiveFailures++
+		} else {
+			r.succeeded = true
+			r.consecutiveFailures = 0
+		}
+	}
+
+	if r.err == nil {
+		return nil
+	}
+	if !r.succeeded || r.consecutiveFailures >= h.ReadyzFailureThreshold {
+		return fmt.Errorf("%d consecutive checks failed, last error: %w", r.consecutiveFailures, r.err)
+	}
+	return nil
+}
+
+// WaitReady checks Key Vault through the kms servers of every provider until each check succeeded
+// once, waiting interval between two checks of a provider, and returns false if ctx is done first.
+// A successful check is also the result of the readiness check, so /readyz passes at the same time.
+func WaitReady(ctx context.Context, interval time.Duration, healthz ...*HealthZ) bool {
+	for _, h := range healthz {
+		for {
+			err := h.checkBackend(ctx)
+			if err == nil {
+				h.setReady()
+				break
+			}
+			mlog.Info("waiting for the key vault check to succeed", "provider", h.Provider, "error", err)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(interval):
+			}
+		}
+	}
+	return true
+}
+
+// setReady records a successful Key Vault check in the readiness cache.
+func (h *HealthZ) setReady() {
+	r := &h.readiness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	r.err = nil
+	r.succeeded = true
+	r.consecutiveFailures = 0
+}
+
+// checkBackend encrypts and decrypts test data with Key Vault through the gRPC server of the enabled kms versions.
+func (h *HealthZ) checkBackend(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(metrics.WithProvider(ctx, h.Provider), h.RPCTimeout)
+	defer cancel()
+
+	if h.KMSv1Server != nil {
+		if err := h.checkKMSv1RPC(ctx); err != nil {
+			return err
+		}
+	}
+	if h.KMSv2Server != nil {
+		if err := h.checkKMSv2RPC(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
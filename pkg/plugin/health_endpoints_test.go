@@ -0,0 +1,187 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLivezReadyz(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	fakeKMSServer, fakeKMSV2Server, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	// key vault is unavailable
+	mockKVClient.SetEncryptResponse(nil, fmt.Errorf("failed to encrypt"))
+
+	healthz := &HealthZ{
+		KMSv1Server:    fakeKMSServer,
+		KMSv2Server:    fakeKMSV2Server,
+		UnixSocketPath: socketPath,
+		RPCTimeout:     20 * time.Second,
+		HealthCheckURL: &url.URL{
+			Host: net.JoinHostPort("", "8080"),
+			Path: "/healthz",
+		},
+		ReadyzCacheTTL:         time.Minute,
+		ReadyzFailureThreshold: 3,
+	}
+	server := httptest.NewServer(NewHealthZServer("/livez", "/readyz", healthz).Handler)
+	defer server.Close()
+
+	tests := []struct {
+		desc                   string
+		path                   string
+		expectedHTTPStatusCode int
+		expectedBody           []string
+	}{
+		{
+			desc:                   "liveness does not depend on key vault",
+			path:                   "/livez",
+			expectedHTTPStatusCode: http.StatusOK,
+			expectedBody:           []string{"ok"},
+		},
+		{
+			desc:                   "verbose liveness",
+			path:                   "/livez?verbose",
+			expectedHTTPStatusCode: http.StatusOK,
+			expectedBody:           []string{"[+]ping ok", "[+]socket ok", "livez check passed"},
+		},
+		{
+			desc:                   "readiness fails before the first successful key vault check",
+			path:                   "/readyz",
+			expectedHTTPStatusCode: http.StatusServiceUnavailable,
+			expectedBody:           []string{"[+]socket ok", "[-]keyvault failed", "readyz check failed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			respCode, body := doHealthCheck(t, server.URL+test.path)
+			if respCode != test.expectedHTTPStatusCode {
+				t.Fatalf("expected status code: %v, got: %v", test.expectedHTTPStatusCode, respCode)
+			}
+			for _, expected := range test.expectedBody {
+				if !strings.Contains(string(body), expected) {
+					t.Fatalf("expected response body to contain %q, got: %s", expected, string(body))
+				}
+			}
+		})
+	}
+}
+
+func TestCheckLiveKMSv2(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	_, fakeKMSV2Server, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	// key vault is unavailable, and kms v2 Status would probe it without a status prober
+	mockKVClient.SetEncryptResponse(nil, fmt.Errorf("failed to encrypt"))
+
+	healthz := &HealthZ{
+		KMSv2Server:    fakeKMSV2Server,
+		UnixSocketPath: socketPath,
+		RPCTimeout:     20 * time.Second,
+	}
+	if err := healthz.checkLive(context.TODO()); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if calls := mockKVClient.EncryptCalls(); calls != 0 {
+		t.Fatalf("expected liveness not to call key vault, got %d encrypt calls", calls)
+	}
+}
+
+func TestCheckReady(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	fakeKMSServer, fakeKMSV2Server, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	mockKVClient.SetEncryptResponse([]byte("bar"), nil)
+	mockKVClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+
+	healthz := &HealthZ{
+		KMSv1Server:            fakeKMSServer,
+		KMSv2Server:            fakeKMSV2Server,
+		UnixSocketPath:         socketPath,
+		RPCTimeout:             20 * time.Second,
+		ReadyzFailureThreshold: 2,
+	}
+
+	if err := healthz.checkReady(context.TODO()); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	// a single failed check is tolerated
+	mockKVClient.SetEncryptResponse(nil, fmt.Errorf("failed to encrypt"))
+	if err := healthz.checkReady(context.TODO()); err != nil {
+		t.Fatalf("expected err to be nil below the failure threshold, got: %v", err)
+	}
+	if err := healthz.checkReady(context.TODO()); err == nil {
+		t.Fatalf("expected error at the failure threshold, got nil")
+	}
+
+	// the result is reused within the cache ttl
+	healthz.ReadyzCacheTTL = time.Hour
+	mockKVClient.SetEncryptResponse([]byte("bar"), nil)
+	if err := healthz.checkReady(context.TODO()); err == nil {
+		t.Fatalf("expected cached error, got nil")
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	_, fakeKMSV2Server, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	mockKVClient.SetEncryptResponse(nil, fmt.Errorf("failed to encrypt"))
+
+	healthz := &HealthZ{
+		KMSv2Server:            fakeKMSV2Server,
+		UnixSocketPath:         socketPath,
+		RPCTimeout:             20 * time.Second,
+		ReadyzCacheTTL:         time.Hour,
+		ReadyzFailureThreshold: 3,
+	}
+
+	// not ready while key vault fails
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if WaitReady(ctx, 10*time.Millisecond, healthz) {
+		t.Fatalf("expected not to be ready while key vault fails")
+	}
+
+	mockKVClient.SetEncryptResponse([]byte("bar"), nil)
+	mockKVClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+	if !WaitReady(context.Background(), 10*time.Millisecond, healthz) {
+		t.Fatalf("expected to be ready")
+	}
+	// the successful check is the result of the readiness check
+	mockKVClient.SetEncryptResponse(nil, fmt.Errorf("failed to encrypt"))
+	if err := healthz.checkReady(context.TODO()); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+}
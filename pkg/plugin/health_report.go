@@ -0,0 +1,135 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"monis.app/mlog"
+)
+
+const (
+	healthCheckStatusOK     = "ok"
+	healthCheckStatusFailed = "failed"
+
+	socketHealthCheck = "socket"
+	kmsV1HealthCheck  = "kmsv1"
+	kmsV2HealthCheck  = "kmsv2"
+	tokenHealthCheck  = "token"
+	keyHealthCheck    = "key"
+)
+
+// healthReport is the JSON response of the health check.
+type healthReport struct {
+	Status   string              `json:"status"`
+	Provider string              `json:"provider,omitempty"`
+	Checks   []healthCheckResult `json:"checks"`
+}
+
+// healthCheckResult is the result of a single check in the health report.
+type healthCheckResult struct {
+	Name                string     `json:"name"`
+	Status              string     `json:"status"`
+	Error               string     `json:"error,omitempty"`
+	LatencySeconds      float64    `json:"latencySeconds"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	// RequestID is the Key Vault request id of the last request made by the check.
+	RequestID string `json:"requestID,omitempty"`
+}
+
+// healthCheckState is the history of a check across health check requests.
+type healthCheckState struct {
+	lastSuccess         time.Time
+	consecutiveFailures int
+}
+
+// healthCheckHistory keeps the state of each check of a HealthZ.
+type healthCheckHistory struct {
+	mu       sync.Mutex
+	states   map[string]*healthCheckState
+	reporter metrics.HealthStatsReporter
+	once     sync.Once
+}
+
+// record updates the state of the check and reports it as metrics.
+func (hh *healthCheckHistory) record(ctx context.Context, result *healthCheckResult, now time.Time) {
+	hh.once.Do(func() {
+		reporter, err := metrics.NewHealthStatsReporter()
+		if err != nil {
+			mlog.Error("failed to create health stats reporter", err)
+			return
+		}
+		hh.reporter = reporter
+	})
+
+	hh.mu.Lock()
+	if hh.states == nil {
+		hh.states = make(map[string]*healthCheckState)
+	}
+	state, ok := hh.states[result.Name]
+	if !ok {
+		state = &healthCheckState{}
+		hh.states[result.Name] = state
+	}
+	if result.Status == healthCheckStatusOK {
+		state.lastSuccess = now
+		state.consecutiveFailures = 0
+	} else {
+		state.consecutiveFailures++
+	}
+	lastSuccess, consecutiveFailures := state.lastSuccess, state.consecutiveFailures
+	hh.mu.Unlock()
+
+	if !lastSuccess.IsZero() {
+		result.LastSuccess = &lastSuccess
+	}
+	result.ConsecutiveFailures = consecutiveFailures
+	if hh.reporter != nil {
+		hh.reporter.ReportHealthCheck(ctx, result.Name, result.Status, result.LatencySeconds, consecutiveFailures, lastSuccess)
+	}
+}
+
+// runCheck runs check, records the Key Vault request id of its last request, and updates the history.
+func (h *HealthZ) runCheck(ctx context.Context, name string, check func(context.Context) error) healthCheckResult {
+	ctx, recorder := withRequestIDRecorder(ctx)
+	start := time.Now()
+	err := check(ctx)
+
+	result := healthCheckResult{
+		Name:           name,
+		Status:         healthCheckStatusOK,
+		LatencySeconds: time.Since(start).Seconds(),
+		RequestID:      recorder.get(),
+	}
+	if err != nil {
+		result.Status = healthCheckStatusFailed
+		result.Error = err.Error()
+	}
+	h.history.record(ctx, &result, time.Now())
+	return result
+}
+
+// wantsJSON returns true if the health report is requested as JSON.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeHealthReport(w http.ResponseWriter, statusCode int, report *healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		mlog.Error("failed to write health report", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	mockkeyvault "github.com/Azure/kubernetes-kms/pkg/plugin/mock_keyvault"
+)
+
+func TestServeJSON(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	fakeKMSServer, fakeKMSV2Server, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	mockKVClient.SetEncryptResponse([]byte("bar"), nil)
+	mockKVClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+	mockKVClient.SetCheckKeyError(fmt.Errorf("key is disabled"))
+
+	healthz := &HealthZ{
+		KMSv1Server:        fakeKMSServer,
+		KMSv2Server:        fakeKMSV2Server,
+		UnixSocketPath:     socketPath,
+		RPCTimeout:         20 * time.Second,
+		CheckKeyAttributes: true,
+	}
+	server := httptest.NewServer(healthz)
+	defer server.Close()
+
+	var report healthReport
+	for i := 0; i < 2; i++ {
+		respCode, body := doHealthCheck(t, server.URL+"?format=json")
+		if respCode != http.StatusInternalServerError {
+			t.Fatalf("expected status code: %v, got: %v", http.StatusInternalServerError, respCode)
+		}
+		if err := json.Unmarshal(body, &report); err != nil {
+			t.Fatalf("failed to decode health report: %v, body: %s", err, string(body))
+		}
+	}
+
+	if report.Status != healthCheckStatusFailed {
+		t.Fatalf("expected report status: %s, got: %s", healthCheckStatusFailed, report.Status)
+	}
+	expected := map[string]string{
+		socketHealthCheck: healthCheckStatusOK,
+		kmsV1HealthCheck:  healthCheckStatusOK,
+		kmsV2HealthCheck:  healthCheckStatusOK,
+		tokenHealthCheck:  healthCheckStatusOK,
+		keyHealthCheck:    healthCheckStatusFailed,
+	}
+	if len(report.Checks) != len(expected) {
+		t.Fatalf("expected %d checks, got: %+v", len(expected), report.Checks)
+	}
+	for _, check := range report.Checks {
+		if check.Status != expected[check.Name] {
+			t.Fatalf("expected check %s status: %s, got: %s", check.Name, expected[check.Name], check.Status)
+		}
+		if check.Status == healthCheckStatusOK && (check.LastSuccess == nil || check.ConsecutiveFailures != 0) {
+			t.Fatalf("expected check %s to have a last success and no failures, got: %+v", check.Name, check)
+		}
+		if check.Status == healthCheckStatusFailed && (check.LastSuccess != nil || check.ConsecutiveFailures != 2 || check.Error == "") {
+			t.Fatalf("expected check %s to have 2 consecutive failures, got: %+v", check.Name, check)
+		}
+	}
+}
+
+func TestServeJSONSocketFailure(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	// nothing listens on the socket
+	mockKVClient := &mockkeyvault.KeyVaultClient{KeyID: "mock-key-id"}
+	healthz := &HealthZ{
+		KMSv2Server:    &KeyManagementServiceV2Server{kvClient: mockKVClient},
+		UnixSocketPath: socketPath,
+		RPCTimeout:     2 * time.Second,
+	}
+	server := httptest.NewServer(healthz)
+	defer server.Close()
+
+	respCode, body := doHealthCheck(t, server.URL+"?format=json")
+	if respCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code: %v, got: %v", http.StatusServiceUnavailable, respCode)
+	}
+	var report healthReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("failed to decode health report: %v, body: %s", err, string(body))
+	}
+	// the key vault checks are skipped
+	if len(report.Checks) != 1 || report.Checks[0].Name != socketHealthCheck {
+		t.Fatalf("expected only the socket check, got: %+v", report.Checks)
+	}
+	if calls := mockKVClient.EncryptCalls(); calls != 0 {
+		t.Fatalf("expected no encrypt calls, got: %d", calls)
+	}
+}
+
+// blockingTokenKeyVaultClient ignores ctx in CheckToken, like authorizers that refresh the token without it.
+type blockingTokenKeyVaultClient struct {
+	*mockkeyvault.KeyVaultClient
+	release chan struct{}
+}
+
+func (c *blockingTokenKeyVaultClient) CheckToken(_ context.Context) error {
+	<-c.release
+	return nil
+}
+
+func TestCheckTokenTimeout(t *testing.T) {
+	kvClient := &blockingTokenKeyVaultClient{KeyVaultClient: &mockkeyvault.KeyVaultClient{}, release: make(chan struct{})}
+	defer close(kvClient.release)
+	healthz := &HealthZ{
+		KMSv2Server: &KeyManagementServiceV2Server{kvClient: kvClient},
+		RPCTimeout:  100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	if err := healthz.checkToken(context.Background()); err == nil {
+		t.Fatalf("expected timeout error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the check to return after the timeout, took: %v", elapsed)
+	}
+}
+
+func TestRecordRequestID(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(requestIDAnnotationValue, "request-id")
+
+	// no recorder in the context
+	recordRequestID(context.Background(), resp)
+
+	ctx, recorder := withRequestIDRecorder(context.Background())
+	recordRequestID(ctx, nil)
+	if got := recorder.get(); got != "" {
+		t.Fatalf("expected empty request id, got: %s", got)
+	}
+	recordRequestID(ctx, resp)
+	if got := recorder.get(); got != "request-id" {
+		t.Fatalf("expected request id: %s, got: %s", "request-id", got)
+	}
+}
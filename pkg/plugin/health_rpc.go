@@ -0,0 +1,104 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// healthCheckMetadataKey marks the health check requests sent over gRPC.
+	healthCheckMetadataKey = "x-azure-kms-health-check"
+	// requestIDMetadataKey returns the Key Vault request id of a health check request in the trailer.
+	requestIDMetadataKey = "x-ms-request-id"
+	// healthCheckUIDPrefix allows us to differentiate the UIDs generated by us from those generated by the API server
+	// in the logs. It is not trusted to tell the origin of a request, since any client can set it.
+	healthCheckUIDPrefix = "local-healthz-check-"
+)
+
+// healthCheckToken is generated for each process, so only the health checks sent by this
+// process are trusted, and not a client that sets healthCheckMetadataKey itself.
+var healthCheckToken = newHealthCheckToken()
+
+func newHealthCheckToken() string {
+	b := make([]byte, 32)
+	// rand.Read never returns an error
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withHealthCheck marks ctx as a health check, in-process and in the metadata of the gRPC
+// requests made with it, so its requests are tagged with the healthz origin and are not
+// counted as kms v1 usage.
+func withHealthCheck(ctx context.Context) context.Context {
+	ctx = metrics.WithOrigin(ctx, metrics.OriginHealthz)
+	return metadata.AppendToOutgoingContext(ctx, healthCheckMetadataKey, healthCheckToken)
+}
+
+// isHealthCheck returns true for the health checks of this process: ctx is marked in-process,
+// or its metadata carries the health check token of this process.
+func isHealthCheck(ctx context.Context) bool {
+	if metrics.Origin(ctx) == metrics.OriginHealthz {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, token := range md.Get(healthCheckMetadataKey) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(healthCheckToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the origin of a request received over gRPC. Only the health checks of
+// this process are tagged with the healthz origin, so requests from other clients are never
+// excluded from the audit log.
+func requestOrigin(ctx context.Context) string {
+	if isHealthCheck(ctx) {
+		return metrics.OriginHealthz
+	}
+	return metrics.OriginAPIServer
+}
+
+// OriginUnaryInterceptor tags each request with its origin, so health checks can be told apart
+// from kube-apiserver requests in metrics and logs. It must run before the metrics interceptor.
+// It also returns the Key Vault request id of health check requests in the trailer, so the
+// health report can show it although the check is sent over gRPC.
+func OriginUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	origin := requestOrigin(ctx)
+	ctx = metrics.WithOrigin(ctx, origin)
+	if origin != metrics.OriginHealthz {
+		return handler(ctx, req)
+	}
+	ctx, recorder := withRequestIDRecorder(ctx)
+	resp, err := handler(ctx, req)
+	if requestID := recorder.get(); requestID != "" {
+		// the trailer cannot be set on calls that are not sent over gRPC
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(requestIDMetadataKey, requestID))
+	}
+	return resp, err
+}
+
+// recordRequestIDTrailer records the Key Vault request id returned in the trailer of a health check request.
+func recordRequestIDTrailer(ctx context.Context, trailer metadata.MD) {
+	recorder, ok := ctx.Value(requestIDRecorderContextKey{}).(*requestIDRecorder)
+	if !ok {
+		return
+	}
+	if requestIDs := trailer.Get(requestIDMetadataKey); len(requestIDs) > 0 {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		recorder.requestID = requestIDs[len(requestIDs)-1]
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	kmsv1 "k8s.io/kms/apis/v1beta1"
+	kmsv2 "k8s.io/kms/apis/v2"
+)
+
+// requestIDKMSServer returns a Key Vault request id for every request, like KeyVaultClient.
+type requestIDKMSServer struct {
+	kmsv1.UnimplementedKeyManagementServiceServer
+	healthChecks int
+}
+
+func (s *requestIDKMSServer) Encrypt(ctx context.Context, _ *kmsv1.EncryptRequest) (*kmsv1.EncryptResponse, error) {
+	s.record(ctx, "encrypt-request-id")
+	return &kmsv1.EncryptResponse{Cipher: []byte("bar")}, nil
+}
+
+func (s *requestIDKMSServer) Decrypt(ctx context.Context, _ *kmsv1.DecryptRequest) (*kmsv1.DecryptResponse, error) {
+	s.record(ctx, "decrypt-request-id")
+	return &kmsv1.DecryptResponse{Plain: []byte(healthCheckPlainText)}, nil
+}
+
+func (s *requestIDKMSServer) record(ctx context.Context, requestID string) {
+	if isHealthCheck(ctx) {
+		s.healthChecks++
+	}
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(requestIDAnnotationValue, requestID)
+	recordRequestID(ctx, resp)
+}
+
+func TestHealthCheckOverGRPC(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	kmsServer := &requestIDKMSServer{}
+	s := grpc.NewServer(grpc.UnaryInterceptor(OriginUnaryInterceptor))
+	kmsv1.RegisterKeyManagementServiceServer(s, kmsServer)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create connection: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, recorder := withRequestIDRecorder(context.Background())
+	if err := checkKMSv1(ctx, kmsv1.NewKeyManagementServiceClient(conn)); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if kmsServer.healthChecks != 2 {
+		t.Fatalf("expected 2 requests marked as health check, got: %d", kmsServer.healthChecks)
+	}
+	if got := recorder.get(); got != "decrypt-request-id" {
+		t.Fatalf("expected request id: %s, got: %s", "decrypt-request-id", got)
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		desc           string
+		ctx            context.Context
+		req            interface{}
+		expectedOrigin string
+	}{
+		{
+			desc:           "kube-apiserver request",
+			ctx:            context.Background(),
+			req:            &kmsv2.EncryptRequest{Uid: "a5e4a1d2-5d2c-4b8a-9f31-1f1c7d7c2f6e"},
+			expectedOrigin: metrics.OriginAPIServer,
+		},
+		{
+			desc:           "health check marked in metadata",
+			ctx:            metadata.NewIncomingContext(context.Background(), metadata.Pairs(healthCheckMetadataKey, healthCheckToken)),
+			req:            &kmsv1.EncryptRequest{},
+			expectedOrigin: metrics.OriginHealthz,
+		},
+		{
+			desc:           "health check metadata without the token of the process",
+			ctx:            metadata.NewIncomingContext(context.Background(), metadata.Pairs(healthCheckMetadataKey, "true")),
+			req:            &kmsv1.EncryptRequest{},
+			expectedOrigin: metrics.OriginAPIServer,
+		},
+		{
+			desc:           "health check uid prefix set by another client",
+			ctx:            metadata.NewIncomingContext(context.Background(), metadata.Pairs(healthCheckMetadataKey, "true")),
+			req:            &kmsv2.DecryptRequest{Uid: healthCheckUIDPrefix + "1"},
+			expectedOrigin: metrics.OriginAPIServer,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var origin string
+			handler := func(ctx context.Context, _ interface{}) (interface{}, error) {
+				origin = metrics.Origin(ctx)
+				return nil, nil
+			}
+			if _, err := OriginUnaryInterceptor(test.ctx, test.req, &grpc.UnaryServerInfo{}, handler); err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if origin != test.expectedOrigin {
+				t.Fatalf("expected origin: %s, got: %s", test.expectedOrigin, origin)
+			}
+		})
+	}
+}
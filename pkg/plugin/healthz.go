@@ -7,15 +7,22 @@ package plugin
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
 	"github.com/Azure/kubernetes-kms/pkg/version"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"k8s.io/apimachinery/pkg/util/uuid"
 	kmsv1 "k8s.io/kms/apis/v1beta1"
 	kmsv2 "k8s.io/kms/apis/v2"
@@ -27,39 +34,185 @@ const (
 )
 
 // HealthZ is the health check server for the KMS plugin.
+// A nil KMSv1Server or KMSv2Server is not checked, as that version is disabled.
 type HealthZ struct {
 	KMSv1Server    *KeyManagementServiceServer
 	KMSv2Server    *KeyManagementServiceV2Server
 	HealthCheckURL *url.URL
 	UnixSocketPath string
 	RPCTimeout     time.Duration
+	// TCPAddress is dialed with ClientTLSConfig instead of UnixSocketPath
+	// when the gRPC server listens on tcp with mTLS.
+	TCPAddress      string
+	ClientTLSConfig *tls.Config
+	// Provider tags the metrics of the health check when one process hosts multiple KMS providers.
+	Provider string
+	// ReadyzCacheTTL is the time the result of the Key Vault check on the readiness endpoint is reused.
+	// Readiness fails once ReadyzFailureThreshold checks in a row failed.
+	ReadyzCacheTTL         time.Duration
+	ReadyzFailureThreshold int
+	// CheckKeyAttributes adds a check that the key is enabled and not expired. It requires the get key permission.
+	CheckKeyAttributes bool
+
+	shuttingDown atomic.Bool
+	readiness    readiness
+	history      healthCheckHistory
+
+	connMu sync.Mutex
+	conn   *grpc.ClientConn
 }
 
-// Serve creates the http handler for serving health requests.
-func (h *HealthZ) Serve() {
+// NewHealthZServer returns the server for the health checks of multiple KMS providers,
+// each on its own path. All health checks must share the host of their HealthCheckURL.
+// The liveness and readiness endpoints check all providers, and are not served if their path is empty.
+func NewHealthZServer(livezPath, readyzPath string, healthz ...*HealthZ) *http.Server {
 	serveMux := http.NewServeMux()
-	serveMux.HandleFunc(h.HealthCheckURL.EscapedPath(), h.ServeHTTP)
-	server := &http.Server{
-		Addr:              h.HealthCheckURL.Host,
+	for _, h := range healthz {
+		serveMux.HandleFunc(h.HealthCheckURL.EscapedPath(), h.ServeHTTP)
+	}
+	if livezPath != "" {
+		serveMux.HandleFunc(livezPath, healthChecksHandler("livez", livezChecks(healthz)))
+	}
+	if readyzPath != "" {
+		serveMux.HandleFunc(readyzPath, healthChecksHandler("readyz", readyzChecks(healthz)))
+	}
+	return &http.Server{
+		Addr:              healthz[0].HealthCheckURL.Host,
 		ReadHeaderTimeout: 5 * time.Second,
 		Handler:           serveMux,
 	}
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		mlog.Fatal(err, "failed to start health check server", "url", h.HealthCheckURL.String())
-	}
 }
 
-func (h *HealthZ) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+// Shutdown fails all later health checks, so the plugin is taken out of rotation
+// while in-flight requests are drained.
+func (h *HealthZ) Shutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// ServeHTTP runs all checks and returns "ok", or the error of the first failed check.
+// With ?format=json or an application/json Accept header, it returns a JSON report of all checks.
+func (h *HealthZ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mlog.Trace("Started health check")
-	ctx, cancel := context.WithTimeout(context.Background(), h.RPCTimeout)
+	if h.shuttingDown.Load() {
+		if wantsJSON(r) {
+			writeHealthReport(w, http.StatusServiceUnavailable, &healthReport{Status: "shutting down", Provider: h.Provider, Checks: []healthCheckResult{}})
+			return
+		}
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(metrics.WithProvider(context.Background(), h.Provider), h.RPCTimeout)
 	defer cancel()
 
-	conn, err := h.dialUnixSocket()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	report := &healthReport{Status: healthCheckStatusOK, Provider: h.Provider}
+	statusCode := http.StatusOK
+	var firstErr string
+	for _, c := range h.healthChecks() {
+		result := h.runCheck(ctx, c.name, c.check)
+		report.Checks = append(report.Checks, result)
+		if result.Status == healthCheckStatusOK || statusCode != http.StatusOK {
+			continue
+		}
+		report.Status = healthCheckStatusFailed
+		firstErr = result.Error
+		statusCode = http.StatusInternalServerError
+		if c.name == socketHealthCheck {
+			// the Key Vault checks are not run when the plugin does not respond on its socket
+			statusCode = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	if wantsJSON(r) {
+		writeHealthReport(w, statusCode, report)
+		return
+	}
+	if statusCode != http.StatusOK {
+		http.Error(w, firstErr, statusCode)
 		return
 	}
-	defer conn.Close()
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("ok")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mlog.Trace("Completed health check")
+}
+
+// healthChecks returns the checks of the health check endpoint. Both encryption and decryption
+// calls are made for each enabled version, resulting in a total of 4 calls to the keyvault.
+// Additionally, a health check is performed every 10 seconds.
+func (h *HealthZ) healthChecks() []healthCheck {
+	checks := []healthCheck{{name: socketHealthCheck, check: h.checkSocket}}
+	if h.KMSv1Server != nil {
+		checks = append(checks, healthCheck{name: kmsV1HealthCheck, check: h.checkKMSv1RPC})
+	}
+	if h.KMSv2Server != nil {
+		checks = append(checks, healthCheck{name: kmsV2HealthCheck, check: h.checkKMSv2RPC})
+	}
+	if kvClient := h.kvClient(); kvClient != nil {
+		checks = append(checks, healthCheck{name: tokenHealthCheck, check: h.checkToken})
+		if h.CheckKeyAttributes {
+			checks = append(checks, healthCheck{name: keyHealthCheck, check: kvClient.CheckKey})
+		}
+	}
+	return checks
+}
+
+// kvClient returns the key vault client shared by the kms servers.
+func (h *HealthZ) kvClient() Client {
+	if h.KMSv2Server != nil {
+		return h.KMSv2Server.kvClient
+	}
+	if h.KMSv1Server != nil {
+		return h.KMSv1Server.kvClient
+	}
+	return nil
+}
+
+// checkToken checks that a token for Key Vault can be acquired within RPCTimeout. The token
+// is refreshed in the background, since authorizers may not stop the refresh when ctx is done.
+func (h *HealthZ) checkToken(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.RPCTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.kvClient().CheckToken(ctx)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out acquiring key vault token, error: %w", ctx.Err())
+	}
+}
+
+// checkKMSv1RPC sends the kms v1 round trip through the gRPC server, so a wedged server
+// or a broken interceptor is detected.
+func (h *HealthZ) checkKMSv1RPC(ctx context.Context) error {
+	conn, err := h.connection()
+	if err != nil {
+		return err
+	}
+	return checkKMSv1(ctx, kmsv1.NewKeyManagementServiceClient(conn))
+}
+
+// checkKMSv2RPC sends the kms v2 round trip through the gRPC server.
+func (h *HealthZ) checkKMSv2RPC(ctx context.Context) error {
+	conn, err := h.connection()
+	if err != nil {
+		return err
+	}
+	return checkKMSv2(ctx, kmsv2.NewKeyManagementServiceClient(conn))
+}
+
+// checkSocket checks the gRPC server responds on its socket with the expected versions.
+func (h *HealthZ) checkSocket(ctx context.Context) error {
+	conn, err := h.connection()
+	if err != nil {
+		return err
+	}
 
 	// create the kms client for v1
 	kmsClient := kmsv1.NewKeyManagementServiceClient(conn)
@@ -68,72 +221,59 @@ func (h *HealthZ) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
 	kmsV2Client := kmsv2.NewKeyManagementServiceClient(conn)
 
 	// check version response against KMS-Plugin's gRPC endpoint.
-	err = h.checkRPC(ctx, kmsClient, kmsV2Client)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-
-	// Both encryption and decryption calls are made for each version,
-	// resulting in a total of 4 calls to the keyvault.
-	// Additionally, a health check is performed every 10 seconds.
+	return h.checkRPC(ctx, kmsClient, kmsV2Client)
+}
 
-	// v1 checks
-	// check the configured keyvault, key, key version and permissions are still
-	// valid to encrypt and decrypt with test data.
-	enc, err := h.KMSv1Server.Encrypt(ctx, &kmsv1.EncryptRequest{Plain: []byte(healthCheckPlainText)})
+// checkKMSv1 checks the configured keyvault, key, key version and permissions are still
+// valid to encrypt and decrypt with test data using the kms v1 client.
+func checkKMSv1(ctx context.Context, client kmsv1.KeyManagementServiceClient) error {
+	ctx = withHealthCheck(ctx)
+	var trailer metadata.MD
+	enc, err := client.Encrypt(ctx, &kmsv1.EncryptRequest{Plain: []byte(healthCheckPlainText)}, grpc.Trailer(&trailer))
+	recordRequestIDTrailer(ctx, trailer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	dec, err := h.KMSv1Server.Decrypt(ctx, &kmsv1.DecryptRequest{Cipher: enc.Cipher})
+	dec, err := client.Decrypt(ctx, &kmsv1.DecryptRequest{Cipher: enc.Cipher}, grpc.Trailer(&trailer))
+	recordRequestIDTrailer(ctx, trailer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	if string(dec.Plain) != healthCheckPlainText {
-		http.Error(w, "plain text mismatch after decryption", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("plain text mismatch after decryption")
 	}
+	return nil
+}
 
-	// v2 checks.
-	// appending a string to UUID allows us to differentiate the UUIDs generated by us from those generated by the API server.
-	uid := "local-healthz-check-" + string(uuid.NewUUID())
+// checkKMSv2 checks the configured keyvault, key, key version and permissions are still
+// valid to encrypt and decrypt with test data using the kms v2 client.
+func checkKMSv2(ctx context.Context, client kmsv2.KeyManagementServiceClient) error {
+	ctx = withHealthCheck(ctx)
+	uid := healthCheckUIDPrefix + string(uuid.NewUUID())
 
-	v2EncryptResponse, err := h.KMSv2Server.Encrypt(
-		ctx,
-		&kmsv2.EncryptRequest{
-			Plaintext: []byte(healthCheckPlainText),
-			Uid:       uid,
-		},
-	)
+	var trailer metadata.MD
+	encryptResponse, err := client.Encrypt(ctx, &kmsv2.EncryptRequest{
+		Plaintext: []byte(healthCheckPlainText),
+		Uid:       uid,
+	}, grpc.Trailer(&trailer))
+	recordRequestIDTrailer(ctx, trailer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	v2DecryptResponse, err := h.KMSv2Server.Decrypt(ctx, &kmsv2.DecryptRequest{
-		Ciphertext:  v2EncryptResponse.Ciphertext,
-		KeyId:       v2EncryptResponse.KeyId,
+	decryptResponse, err := client.Decrypt(ctx, &kmsv2.DecryptRequest{
+		Ciphertext:  encryptResponse.Ciphertext,
+		KeyId:       encryptResponse.KeyId,
 		Uid:         uid, // passing the same uid to track roundtrip encrypt/decrypt calls
-		Annotations: v2EncryptResponse.Annotations,
-	})
+		Annotations: encryptResponse.Annotations,
+	}, grpc.Trailer(&trailer))
+	recordRequestIDTrailer(ctx, trailer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if string(v2DecryptResponse.Plaintext) != healthCheckPlainText {
-		http.Error(w, "plain text mismatch after decryption with KMSv2", http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	w.WriteHeader(http.StatusOK)
-	if _, err = w.Write([]byte("ok")); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if string(decryptResponse.Plaintext) != healthCheckPlainText {
+		return fmt.Errorf("plain text mismatch after decryption with KMSv2")
 	}
-	mlog.Trace("Completed health check")
+	return nil
 }
 
 // checkRPC initiates a grpc request to validate the socket is responding
@@ -143,18 +283,26 @@ func (h *HealthZ) checkRPC(
 	kmsV1Client kmsv1.KeyManagementServiceClient,
 	kmsV2Client kmsv2.KeyManagementServiceClient,
 ) error {
-	v, err := kmsV1Client.Version(ctx, &kmsv1.VersionRequest{})
-	if err != nil {
-		return err
+	if h.KMSv1Server != nil {
+		v, err := kmsV1Client.Version(ctx, &kmsv1.VersionRequest{})
+		if err != nil {
+			return err
+		}
+		if v.Version != version.KMSv1APIVersion || v.RuntimeName != version.Runtime || v.RuntimeVersion != version.BuildVersion {
+			return fmt.Errorf("failed to get correct version response")
+		}
 	}
-	if v.Version != version.KMSv1APIVersion || v.RuntimeName != version.Runtime || v.RuntimeVersion != version.BuildVersion {
-		return fmt.Errorf("failed to get correct version response")
+	if h.KMSv2Server == nil {
+		return nil
 	}
 
 	v2Status, err := kmsV2Client.Status(ctx, &kmsv2.StatusRequest{})
 	if err != nil {
 		return err
 	}
+	if v2Status.Healthz != healthzOK {
+		return fmt.Errorf("kms v2 status is not healthy: %s", v2Status.Healthz)
+	}
 	if v2Status.Version != version.KMSv2APIVersion {
 		return fmt.Errorf(
 			"failed to get correct version response for v2 expected: %s, got: %s",
@@ -166,7 +314,30 @@ func (h *HealthZ) checkRPC(
 	return nil
 }
 
-func (h *HealthZ) dialUnixSocket() (*grpc.ClientConn, error) {
+// connection returns the connection to the gRPC server shared by all checks. It is created on
+// first use and reconnects on its own, so a probe does not pay for a new connection.
+func (h *HealthZ) connection() (*grpc.ClientConn, error) {
+	h.connMu.Lock()
+	defer h.connMu.Unlock()
+	if h.conn == nil {
+		conn, err := h.dial()
+		if err != nil {
+			return nil, err
+		}
+		h.conn = conn
+	}
+	return h.conn, nil
+}
+
+func (h *HealthZ) dial() (*grpc.ClientConn, error) {
+	if h.TCPAddress != "" {
+		return grpc.NewClient("passthrough:///"+h.TCPAddress,
+			grpc.WithTransportCredentials(credentials.NewTLS(h.ClientTLSConfig)))
+	}
+	if name, ok := strings.CutPrefix(h.UnixSocketPath, "@"); ok {
+		return grpc.NewClient("unix-abstract:"+name,
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
 	return grpc.NewClient("unix://"+h.UnixSocketPath,
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
 }
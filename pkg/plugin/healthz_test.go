@@ -22,6 +22,8 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	kmsv1 "k8s.io/kms/apis/v1beta1"
 	kmsv2 "k8s.io/kms/apis/v2"
 	"monis.app/mlog"
@@ -105,6 +107,36 @@ func TestServe(t *testing.T) {
 	}
 }
 
+func TestServeShutdown(t *testing.T) {
+	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
+	defer os.Remove(socketPath)
+
+	fakeKMSServer, fakeKMSV2Server, mockKVClient, err := setupFakeKMSServer(socketPath)
+	if err != nil {
+		t.Fatalf("failed to create fake kms server, err: %+v", err)
+	}
+	mockKVClient.SetEncryptResponse([]byte("bar"), nil)
+	mockKVClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+
+	healthz := &HealthZ{
+		KMSv1Server:    fakeKMSServer,
+		KMSv2Server:    fakeKMSV2Server,
+		UnixSocketPath: socketPath,
+		RPCTimeout:     20 * time.Second,
+	}
+	server := httptest.NewServer(healthz)
+	defer server.Close()
+
+	if respCode, _ := doHealthCheck(t, server.URL); respCode != http.StatusOK {
+		t.Fatalf("expected status code: %v, got: %v", http.StatusOK, respCode)
+	}
+	// readiness fails once shutdown starts
+	healthz.Shutdown()
+	if respCode, _ := doHealthCheck(t, server.URL); respCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code: %v, got: %v", http.StatusServiceUnavailable, respCode)
+	}
+}
+
 func TestCheckRPC(t *testing.T) {
 	socketPath := fmt.Sprintf("%s/kms.sock", getTempTestDir(t))
 	defer os.Remove(socketPath)
@@ -121,7 +153,7 @@ func TestCheckRPC(t *testing.T) {
 	mockKVClient.SetEncryptResponse([]byte(healthCheckPlainText), nil)
 	mockKVClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
 
-	conn, err := healthz.dialUnixSocket()
+	conn, err := healthz.dial()
 	if err != nil {
 		t.Fatalf("failed to create connection, err: %+v", err)
 	}
@@ -177,6 +209,7 @@ func setupFakeKMSServer(socketPath string) (
 	s := grpc.NewServer()
 	kmsv1.RegisterKeyManagementServiceServer(s, fakeKMSV1Server)
 	kmsv2.RegisterKeyManagementServiceServer(s, fakeKMSV2Server)
+	healthpb.RegisterHealthServer(s, health.NewServer())
 	go func() {
 		if err := s.Serve(listener); err != nil {
 			mlog.Fatal(err, "failed to serve fake kms server")
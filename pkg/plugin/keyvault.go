@@ -8,16 +8,20 @@ package plugin
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/auth"
 	"github.com/Azure/kubernetes-kms/pkg/config"
 	"github.com/Azure/kubernetes-kms/pkg/consts"
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
 	"github.com/Azure/kubernetes-kms/pkg/utils"
 	"github.com/Azure/kubernetes-kms/pkg/version"
 
@@ -58,8 +62,14 @@ type Client interface {
 		annotations map[string][]byte,
 		decryptRequestKeyID string,
 	) ([]byte, error)
+	// CheckToken checks that a token for Key Vault can be acquired.
+	CheckToken(ctx context.Context) error
+	// CheckKey checks that the key is enabled and within its validity period. It requires the get key permission.
+	CheckKey(ctx context.Context) error
 	GetUserAgent() string
 	GetVaultURL() string
+	// GetKeyID returns the key id returned by Encrypt for the configured key.
+	GetKeyID() string
 }
 
 // KeyVaultClient is a client for interacting with Keyvault.
@@ -72,9 +82,15 @@ type KeyVaultClient struct {
 	vaultURL         string
 	keyIDHash        string
 	azureEnvironment *azure.Environment
+	// explicitVaultURL is set when the vault url is configured instead of built from the vault name.
+	explicitVaultURL bool
+	// vaultHost is the host of the configured vault url without port, before it is rewritten for proxy mode.
+	vaultHost string
 }
 
 // NewKeyVaultClient returns a new key vault client to use for kms operations.
+// The vault is identified by vaultName, or by vaultURL for vaults that are not reachable
+// at https://<vaultName>.<dns suffix>/, e.g. private link aliases and custom DNS.
 func NewKeyVaultClient(
 	config *config.AzureConfig,
 	vaultName, keyName, keyVersion string,
@@ -82,16 +98,23 @@ func NewKeyVaultClient(
 	proxyAddress string,
 	proxyPort int,
 	managedHSM bool,
+	proxyTLSConfig *tls.Config,
+	httpProxy *utils.HTTPProxyConfig,
+	vaultURL string,
 ) (Client, error) {
 	// Sanitize vaultName, keyName, keyVersion. (https://github.com/Azure/kubernetes-kms/issues/85)
 	vaultName = utils.SanitizeString(vaultName)
 	keyName = utils.SanitizeString(keyName)
 	keyVersion = utils.SanitizeString(keyVersion)
+	vaultURL = utils.SanitizeString(vaultURL)
 
+	if len(vaultName) != 0 && len(vaultURL) != 0 {
+		return nil, fmt.Errorf("key vault name and vault url are mutually exclusive")
+	}
 	// this should be the case for bring your own key, clusters bootstrapped with
 	// aks-engine or aks and standalone kms plugin deployments
-	if len(vaultName) == 0 || len(keyName) == 0 || len(keyVersion) == 0 {
-		return nil, fmt.Errorf("key vault name, key name and key version are required")
+	if (len(vaultName) == 0 && len(vaultURL) == 0) || len(keyName) == 0 || len(keyVersion) == 0 {
+		return nil, fmt.Errorf("key vault name or vault url, key name and key version are required")
 	}
 	kvClient := kv.New()
 	err := kvClient.AddToUserAgent(version.GetUserAgent())
@@ -102,36 +125,65 @@ func NewKeyVaultClient(
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse cloud environment: %s, error: %w", config.Cloud, err)
 	}
+	var sender autorest.Sender
 	if proxyMode {
-		env.ActiveDirectoryEndpoint = fmt.Sprintf("http://%s:%d/", proxyAddress, proxyPort)
+		env.ActiveDirectoryEndpoint = fmt.Sprintf("%s://%s:%d/", getProxyScheme(proxyTLSConfig), proxyAddress, proxyPort)
+		if proxyTLSConfig != nil {
+			sender = newSender(proxyTLSConfig, nil)
+		}
+	} else if httpProxy != nil {
+		proxyFunc, err := httpProxy.ProxyFunc()
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure http proxy, error: %w", err)
+		}
+		sender = newSender(&tls.Config{MinVersion: tls.VersionTLS12}, proxyFunc)
 	}
+	upstreamReporter, err := metrics.NewUpstreamStatsReporter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream stats reporter, error: %w", err)
+	}
+	kvSender := sender
+	if kvSender == nil {
+		kvSender = autorest.CreateSender()
+	}
+	kvClient.Sender = autorest.DecorateSender(kvSender, withUpstreamMetrics(upstreamReporter, consts.TargetTypeKeyVault))
 
-	vaultResourceURL := getVaultResourceIdentifier(managedHSM, env)
+	vaultResourceURL := getVaultResourceIdentifier(managedHSM, env, auth.IsADFS(config))
 	if vaultResourceURL == azure.NotAvailable {
 		return nil, fmt.Errorf("keyvault resource identifier not available for cloud: %s", env.Name)
 	}
-	token, err := auth.GetKeyvaultToken(config, env, vaultResourceURL, proxyMode)
+	token, err := auth.GetKeyvaultToken(config, env, vaultResourceURL, proxyMode, sender, withUpstreamMetrics(upstreamReporter, consts.TargetTypeAzureActiveDirectory))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get key vault token, error: %w", err)
 	}
 	kvClient.Authorizer = token
 
-	vaultURL, err := getVaultURL(vaultName, managedHSM, env)
+	explicitVaultURL := len(vaultURL) != 0
+	var resolvedVaultURL *string
+	if explicitVaultURL {
+		resolvedVaultURL, err = parseVaultURL(vaultURL)
+	} else {
+		resolvedVaultURL, err = getVaultURL(vaultName, managedHSM, env)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get vault url, error: %w", err)
 	}
 
-	keyIDHash, err := getKeyIDHash(*vaultURL, keyName, keyVersion)
+	keyIDHash, err := getKeyIDHash(*resolvedVaultURL, keyName, keyVersion)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get key id hash, error: %w", err)
 	}
+	vaultHost, err := getVaultHost(*resolvedVaultURL)
+	if err != nil {
+		return nil, err
+	}
 
 	if proxyMode {
 		kvClient.RequestInspector = autorest.WithHeader(consts.RequestHeaderTargetType, consts.TargetTypeKeyVault)
-		vaultURL = getProxiedVaultURL(vaultURL, proxyAddress, proxyPort)
+		resolvedVaultURL = getProxiedVaultURL(resolvedVaultURL, getProxyScheme(proxyTLSConfig), proxyAddress, proxyPort)
 	}
 
-	mlog.Always("using kms key for encrypt/decrypt", "vaultURL", *vaultURL, "keyName", keyName, "keyVersion", keyVersion)
+	mlog.Always("using kms key for encrypt/decrypt", "vaultURL", *resolvedVaultURL, "keyName", keyName, "keyVersion", keyVersion)
 
 	client := &KeyVaultClient{
 		baseClient:       kvClient,
@@ -139,9 +191,11 @@ func NewKeyVaultClient(
 		vaultName:        vaultName,
 		keyName:          keyName,
 		keyVersion:       keyVersion,
-		vaultURL:         *vaultURL,
+		vaultURL:         *resolvedVaultURL,
 		azureEnvironment: env,
 		keyIDHash:        keyIDHash,
+		explicitVaultURL: explicitVaultURL,
+		vaultHost:        vaultHost,
 	}
 	return client, nil
 }
@@ -158,17 +212,19 @@ func (kvc *KeyVaultClient) Encrypt(
 		Algorithm: encryptionAlgorithm,
 		Value:     &value,
 	}
+	ctx = withUpstreamAttempts(ctx)
 	result, err := kvc.baseClient.Encrypt(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
+	recordRequestID(ctx, result.Response.Response)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt, error: %w", err)
+		return nil, classifyError(fmt.Errorf("failed to encrypt, error: %w", err), result.Response.Response)
 	}
 
-	if kvc.keyIDHash != fmt.Sprintf("%x", sha256.Sum256([]byte(*result.Kid))) {
-		return nil, fmt.Errorf(
+	if !kvc.isExpectedKeyID(*result.Kid) {
+		return nil, newError(ErrKeyIDMismatch, fmt.Errorf(
 			"key id initialized does not match with the key id from encryption result, expected: %s, got: %s",
 			kvc.keyIDHash,
 			*result.Kid,
-		)
+		), result.Response.Response)
 	}
 
 	annotations := map[string][]byte{
@@ -208,9 +264,11 @@ func (kvc *KeyVaultClient) Decrypt(
 		Value:     &value,
 	}
 
+	ctx = withUpstreamAttempts(ctx)
 	result, err := kvc.baseClient.Decrypt(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
+	recordRequestID(ctx, result.Response.Response)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt, error: %w", err)
+		return nil, classifyError(fmt.Errorf("failed to decrypt, error: %w", err), result.Response.Response)
 	}
 	bytes, err := base64.RawURLEncoding.DecodeString(*result.Result)
 	if err != nil {
@@ -220,6 +278,61 @@ func (kvc *KeyVaultClient) Decrypt(
 	return bytes, nil
 }
 
+// isExpectedKeyID returns true if kid from the encryption result is the key used by the client.
+// An explicit vault url may differ from the kid returned by Key Vault in case or port, so the
+// host without port and the key path are compared case-insensitively in that case.
+func (kvc *KeyVaultClient) isExpectedKeyID(kid string) bool {
+	if kvc.keyIDHash == fmt.Sprintf("%x", sha256.Sum256([]byte(kid))) {
+		return true
+	}
+	if !kvc.explicitVaultURL {
+		return false
+	}
+	kidURL, err := url.Parse(kid)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(kidURL.Hostname(), kvc.vaultHost) &&
+		strings.EqualFold(kidURL.Path, "/"+path.Join("keys", kvc.keyName, kvc.keyVersion))
+}
+
+// CheckToken acquires a token for Key Vault, or reuses the cached token if it is still fresh.
+func (kvc *KeyVaultClient) CheckToken(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(withUpstreamAttempts(ctx), http.MethodGet, kvc.vaultURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request, error: %w", err)
+	}
+	if _, err := autorest.Prepare(req, kvc.baseClient.Authorizer.WithAuthorization()); err != nil {
+		return classifyError(fmt.Errorf("failed to get key vault token, error: %w", err), nil)
+	}
+	return nil
+}
+
+// CheckKey checks the attributes of the key, so a disabled or expired key is reported before encryption fails.
+func (kvc *KeyVaultClient) CheckKey(ctx context.Context) error {
+	ctx = withUpstreamAttempts(ctx)
+	result, err := kvc.baseClient.GetKey(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion)
+	recordRequestID(ctx, result.Response.Response)
+	if err != nil {
+		return classifyError(fmt.Errorf("failed to get key, error: %w", err), result.Response.Response)
+	}
+	attributes := result.Attributes
+	if attributes == nil {
+		return nil
+	}
+	now := time.Now()
+	if attributes.Enabled != nil && !*attributes.Enabled {
+		return newError(ErrKeyDisabled, fmt.Errorf("key %s version %s is disabled", kvc.keyName, kvc.keyVersion), result.Response.Response)
+	}
+	if attributes.NotBefore != nil && now.Before(time.Time(*attributes.NotBefore)) {
+		return newError(ErrKeyDisabled, fmt.Errorf("key %s version %s is not valid before %s", kvc.keyName, kvc.keyVersion, time.Time(*attributes.NotBefore).UTC().Format(time.RFC3339)), result.Response.Response)
+	}
+	if attributes.Expires != nil && now.After(time.Time(*attributes.Expires)) {
+		return newError(ErrKeyDisabled, fmt.Errorf("key %s version %s expired at %s", kvc.keyName, kvc.keyVersion, time.Time(*attributes.Expires).UTC().Format(time.RFC3339)), result.Response.Response)
+	}
+	return nil
+}
+
 func (kvc *KeyVaultClient) GetUserAgent() string {
 	return kvc.baseClient.UserAgent
 }
@@ -228,6 +341,10 @@ func (kvc *KeyVaultClient) GetVaultURL() string {
 	return kvc.vaultURL
 }
 
+func (kvc *KeyVaultClient) GetKeyID() string {
+	return kvc.keyIDHash
+}
+
 // ValidateAnnotations validates following annotations before decryption:
 // - Algorithm.
 // - Version.
@@ -238,33 +355,33 @@ func (kvc *KeyVaultClient) validateAnnotations(
 	encryptionAlgorithm kv.JSONWebKeyEncryptionAlgorithm,
 ) error {
 	if len(annotations) == 0 {
-		return fmt.Errorf("invalid annotations, annotations cannot be empty")
+		return newError(ErrInvalidAnnotations, fmt.Errorf("invalid annotations, annotations cannot be empty"), nil)
 	}
 
 	if keyID != kvc.keyIDHash {
-		return fmt.Errorf(
+		return newError(ErrKeyIDMismatch, fmt.Errorf(
 			"key id %s does not match expected key id %s used for encryption",
 			keyID,
 			kvc.keyIDHash,
-		)
+		), nil)
 	}
 
 	algorithm := string(annotations[algorithmAnnotationKey])
 	if algorithm != string(encryptionAlgorithm) {
-		return fmt.Errorf(
+		return newError(ErrInvalidAnnotations, fmt.Errorf(
 			"algorithm %s does not match expected algorithm %s used for encryption",
 			algorithm,
 			encryptionAlgorithm,
-		)
+		), nil)
 	}
 
 	version := string(annotations[versionAnnotationKey])
 	if version != encryptionResponseVersion {
-		return fmt.Errorf(
+		return newError(ErrInvalidAnnotations, fmt.Errorf(
 			"version %s does not match expected version %s used for encryption",
 			version,
 			encryptionResponseVersion,
-		)
+		), nil)
 	}
 
 	return nil
@@ -291,23 +408,108 @@ func getVaultURL(vaultName string, managedHSM bool, env *azure.Environment) (vau
 	return &vaultURI, nil
 }
 
-func getProxiedVaultURL(vaultURL *string, proxyAddress string, proxyPort int) *string {
-	proxiedVaultURL := fmt.Sprintf("http://%s:%d/%s", proxyAddress, proxyPort, strings.TrimPrefix(*vaultURL, "https://"))
+// getVaultHost returns the host of vaultURL without port.
+func getVaultHost(vaultURL string) (string, error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse vault url %q, error: %w", vaultURL, err)
+	}
+	return u.Hostname(), nil
+}
+
+// parseVaultURL validates an explicit vault url and returns it in the form https://<host>/, without the default port.
+func parseVaultURL(vaultURL string) (*string, error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vault url %q, error: %w", vaultURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid vault url %q, must be in the form https://<host>/", vaultURL)
+	}
+	if (u.Path != "" && u.Path != "/") || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid vault url %q, must not contain a path, credentials, query or fragment", vaultURL)
+	}
+	// the default port is dropped, so the host forwarded in proxy mode matches the allowed vault hosts
+	host := u.Hostname()
+	if port := u.Port(); port != "" && port != "443" {
+		return nil, fmt.Errorf("invalid vault url %q, must not contain a port other than 443", vaultURL)
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	vaultURI := fmt.Sprintf("https://%s/", strings.ToLower(host))
+	return &vaultURI, nil
+}
+
+// ParseKeyID parses a full key identifier in the form https://<host>/keys/<name>/<version>
+// and returns the vault url, key name and key version.
+func ParseKeyID(keyID string) (vaultURL, keyName, keyVersion string, err error) {
+	keyID = utils.SanitizeString(keyID)
+	u, err := url.Parse(keyID)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to parse key id %q, error: %w", keyID, err)
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) != 3 || segments[0] != "keys" || segments[1] == "" || segments[2] == "" {
+		return "", "", "", fmt.Errorf("invalid key id %q, must be in the form https://<host>/keys/<name>/<version>", keyID)
+	}
+	u.Path = "/"
+	parsedVaultURL, err := parseVaultURL(u.String())
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid key id %q, error: %w", keyID, err)
+	}
+	return *parsedVaultURL, segments[1], segments[2], nil
+}
+
+func getProxiedVaultURL(vaultURL *string, proxyScheme, proxyAddress string, proxyPort int) *string {
+	proxiedVaultURL := fmt.Sprintf("%s://%s:%d/%s", proxyScheme, proxyAddress, proxyPort, strings.TrimPrefix(*vaultURL, "https://"))
 	return &proxiedVaultURL
 }
 
+// getProxyScheme returns the scheme used to connect to the proxy in proxy mode.
+func getProxyScheme(proxyTLSConfig *tls.Config) string {
+	if proxyTLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// newSender returns a sender that uses the given TLS config and forward proxy.
+// The default forward proxy from the environment is used if proxy is nil.
+func newSender(tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) autorest.Sender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if proxy != nil {
+		transport.Proxy = proxy
+	}
+	return &http.Client{Transport: transport}
+}
+
 func getVaultDNSSuffix(managedHSM bool, env *azure.Environment) string {
+	suffix := env.KeyVaultDNSSuffix
 	if managedHSM {
-		return env.ManagedHSMDNSSuffix
+		suffix = env.ManagedHSMDNSSuffix
 	}
-	return env.KeyVaultDNSSuffix
+	// custom environments loaded from file may leave unsupported endpoints empty
+	if suffix == "" {
+		return azure.NotAvailable
+	}
+	return suffix
 }
 
-func getVaultResourceIdentifier(managedHSM bool, env *azure.Environment) string {
+func getVaultResourceIdentifier(managedHSM bool, env *azure.Environment, adfs bool) string {
+	resource := env.ResourceIdentifiers.KeyVault
 	if managedHSM {
-		return env.ResourceIdentifiers.ManagedHSM
+		resource = env.ResourceIdentifiers.ManagedHSM
+	}
+	if resource == "" || resource == azure.NotAvailable {
+		return azure.NotAvailable
+	}
+	// ADFS relying parties are registered without the trailing slash
+	if adfs {
+		return strings.TrimSuffix(resource, "/")
 	}
-	return env.ResourceIdentifiers.KeyVault
+	return resource
 }
 
 func getKeyIDHash(vaultURL, keyName, keyVersion string) (string, error) {
@@ -6,12 +6,34 @@
 package plugin
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/auth"
 	"github.com/Azure/kubernetes-kms/pkg/config"
+	"github.com/Azure/kubernetes-kms/pkg/consts"
+	"github.com/Azure/kubernetes-kms/pkg/utils"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/azure"
 )
 
 var (
@@ -30,6 +52,7 @@ func TestNewKeyVaultClientError(t *testing.T) {
 		proxyAddress string
 		proxyPort    int
 		managedHSM   bool
+		vaultURL     string
 	}{
 		{
 			desc:      "vault name not provided",
@@ -64,11 +87,33 @@ func TestNewKeyVaultClientError(t *testing.T) {
 			keyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
 			managedHSM: true,
 		},
+		{
+			desc:       "vault name and vault url both provided",
+			config:     &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultName:  "testkv",
+			vaultURL:   "https://testkv.vault.azure.net/",
+			keyName:    "key1",
+			keyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:       "invalid vault url",
+			config:     &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultURL:   "http://testkv.vault.azure.net/",
+			keyName:    "key1",
+			keyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:       "vault url with a port other than 443",
+			config:     &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultURL:   "https://testkv.vault.azure.net:8443/",
+			keyName:    "key1",
+			keyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			if _, err := NewKeyVaultClient(test.config, test.vaultName, test.keyName, test.keyVersion, test.proxyMode, test.proxyAddress, test.proxyPort, test.managedHSM); err == nil {
+			if _, err := NewKeyVaultClient(test.config, test.vaultName, test.keyName, test.keyVersion, test.proxyMode, test.proxyAddress, test.proxyPort, test.managedHSM, nil, nil, test.vaultURL); err == nil {
 				t.Fatalf("newKeyVaultClient() expected error, got nil")
 			}
 		})
@@ -86,6 +131,8 @@ func TestNewKeyVaultClient(t *testing.T) {
 		proxyAddress     string
 		proxyPort        int
 		managedHSM       bool
+		proxyTLSConfig   *tls.Config
+		vaultURL         string
 		expectedVaultURL string
 	}{
 		{
@@ -117,6 +164,18 @@ func TestNewKeyVaultClient(t *testing.T) {
 			proxyPort:        7788,
 			expectedVaultURL: "http://localhost:7788/testkv.vault.azure.net/",
 		},
+		{
+			desc:             "no error with proxy mode over tls",
+			config:           &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultName:        "testkv",
+			keyName:          "key1",
+			keyVersion:       "262067a9e8ba401aa8a746c5f1a7e147",
+			proxyMode:        true,
+			proxyAddress:     "localhost",
+			proxyPort:        7788,
+			proxyTLSConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+			expectedVaultURL: "https://localhost:7788/testkv.vault.azure.net/",
+		},
 		{
 			desc:             "no error with managed hsm",
 			config:           &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
@@ -127,11 +186,41 @@ func TestNewKeyVaultClient(t *testing.T) {
 			proxyMode:        false,
 			expectedVaultURL: "https://testkv.managedhsm.azure.net/",
 		},
+		{
+			desc:             "no error with vault url",
+			config:           &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultURL:         "https://TestKV.privatelink.contoso.com",
+			keyName:          "key1",
+			keyVersion:       "262067a9e8ba401aa8a746c5f1a7e147",
+			expectedVaultURL: "https://testkv.privatelink.contoso.com/",
+		},
+		{
+			desc:             "no error with vault url in proxy mode",
+			config:           &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultURL:         "https://testkv.privatelink.contoso.com/",
+			keyName:          "key1",
+			keyVersion:       "262067a9e8ba401aa8a746c5f1a7e147",
+			proxyMode:        true,
+			proxyAddress:     "localhost",
+			proxyPort:        7788,
+			expectedVaultURL: "http://localhost:7788/testkv.privatelink.contoso.com/",
+		},
+		{
+			desc:             "no error with vault url with default port in proxy mode",
+			config:           &config.AzureConfig{ClientID: "clientid", ClientSecret: "clientsecret"},
+			vaultURL:         "https://testkv.vault.azure.net:443/",
+			keyName:          "key1",
+			keyVersion:       "262067a9e8ba401aa8a746c5f1a7e147",
+			proxyMode:        true,
+			proxyAddress:     "localhost",
+			proxyPort:        7788,
+			expectedVaultURL: "http://localhost:7788/testkv.vault.azure.net/",
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			kvClient, err := NewKeyVaultClient(test.config, test.vaultName, test.keyName, test.keyVersion, test.proxyMode, test.proxyAddress, test.proxyPort, test.managedHSM)
+			kvClient, err := NewKeyVaultClient(test.config, test.vaultName, test.keyName, test.keyVersion, test.proxyMode, test.proxyAddress, test.proxyPort, test.managedHSM, test.proxyTLSConfig, nil, test.vaultURL)
 			if err != nil {
 				t.Fatalf("newKeyVaultClient() failed with error: %v", err)
 			}
@@ -204,6 +293,396 @@ func TestGetVaultURL(t *testing.T) {
 	}
 }
 
+func TestParseKeyID(t *testing.T) {
+	tests := []struct {
+		desc               string
+		keyID              string
+		expectedVaultURL   string
+		expectedKeyName    string
+		expectedKeyVersion string
+		expectedError      bool
+	}{
+		{
+			desc:               "key vault key id",
+			keyID:              "https://testkv.vault.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147",
+			expectedVaultURL:   "https://testkv.vault.azure.net/",
+			expectedKeyName:    "key1",
+			expectedKeyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:               "managed hsm key id with quotes",
+			keyID:              "\"https://test-hsm.managedhsm.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147\"",
+			expectedVaultURL:   "https://test-hsm.managedhsm.azure.net/",
+			expectedKeyName:    "key1",
+			expectedKeyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:               "key id with default port",
+			keyID:              "https://testkv.vault.azure.net:443/keys/key1/262067a9e8ba401aa8a746c5f1a7e147",
+			expectedVaultURL:   "https://testkv.vault.azure.net/",
+			expectedKeyName:    "key1",
+			expectedKeyVersion: "262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:          "missing key version",
+			keyID:         "https://testkv.vault.azure.net/keys/key1",
+			expectedError: true,
+		},
+		{
+			desc:          "secret id",
+			keyID:         "https://testkv.vault.azure.net/secrets/key1/262067a9e8ba401aa8a746c5f1a7e147",
+			expectedError: true,
+		},
+		{
+			desc:          "http scheme",
+			keyID:         "http://testkv.vault.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147",
+			expectedError: true,
+		},
+		{
+			desc:          "query string",
+			keyID:         "https://testkv.vault.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147?api-version=7.0",
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			vaultURL, keyName, keyVersion, err := ParseKeyID(test.keyID)
+			if test.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if vaultURL != test.expectedVaultURL || keyName != test.expectedKeyName || keyVersion != test.expectedKeyVersion {
+				t.Fatalf("expected %s, %s, %s, got: %s, %s, %s", test.expectedVaultURL, test.expectedKeyName, test.expectedKeyVersion, vaultURL, keyName, keyVersion)
+			}
+		})
+	}
+}
+
+func TestIsExpectedKeyID(t *testing.T) {
+	keyIDHash, err := getKeyIDHash("https://testkv.privatelink.contoso.com/", "key1", "262067a9e8ba401aa8a746c5f1a7e147")
+	if err != nil {
+		t.Fatalf("failed to get key id hash: %v", err)
+	}
+
+	tests := []struct {
+		desc             string
+		explicitVaultURL bool
+		kid              string
+		expected         bool
+	}{
+		{
+			desc:     "same key id",
+			kid:      "https://testkv.privatelink.contoso.com/keys/key1/262067a9e8ba401aa8a746c5f1a7e147",
+			expected: true,
+		},
+		{
+			desc: "vault host differs",
+			kid:  "https://testkv.vault.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:             "port and case differ with explicit vault url",
+			explicitVaultURL: true,
+			kid:              "https://TestKV.privatelink.contoso.com:443/keys/Key1/262067a9e8ba401aa8a746c5f1a7e147",
+			expected:         true,
+		},
+		{
+			desc:             "vault host differs with explicit vault url",
+			explicitVaultURL: true,
+			kid:              "https://testkv.vault.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147",
+		},
+		{
+			desc:             "key version differs with explicit vault url",
+			explicitVaultURL: true,
+			kid:              "https://testkv.privatelink.contoso.com/keys/key1/9d34a4f8e0a14fb1a6d1c8a1e4e0f2f3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			kvc := &KeyVaultClient{
+				keyName:          "key1",
+				keyVersion:       "262067a9e8ba401aa8a746c5f1a7e147",
+				keyIDHash:        keyIDHash,
+				explicitVaultURL: test.explicitVaultURL,
+				vaultHost:        "testkv.privatelink.contoso.com",
+			}
+			if actual := kvc.isExpectedKeyID(test.kid); actual != test.expected {
+				t.Fatalf("expected: %v, got: %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNewKeyVaultClientWithCustomEnvironment(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "azurestackcloud.json")
+	envJSON := `{
+		"name": "AzureStackCloud",
+		"activeDirectoryEndpoint": "https://adfs.local.azurestack.external/",
+		"keyVaultDNSSuffix": "vault.local.azurestack.external",
+		"resourceIdentifiers": {
+			"keyVault": "https://vault.local.azurestack.external/"
+		}
+	}`
+	if err := os.WriteFile(envFile, []byte(envJSON), 0o600); err != nil {
+		t.Fatalf("failed to write environment file: %v", err)
+	}
+	t.Setenv(azure.EnvironmentFilepathName, envFile)
+
+	cfg := &config.AzureConfig{
+		Cloud:          "AzureStackCloud",
+		ClientID:       "clientid",
+		ClientSecret:   "clientsecret",
+		IdentitySystem: "adfs",
+	}
+
+	kvClient, err := NewKeyVaultClient(cfg, "testkv", "key1", "262067a9e8ba401aa8a746c5f1a7e147", false, "", 0, false, nil, nil, "")
+	if err != nil {
+		t.Fatalf("newKeyVaultClient() failed with error: %v", err)
+	}
+	if kvClient.GetVaultURL() != "https://testkv.vault.local.azurestack.external/" {
+		t.Fatalf("expected vault URL: https://testkv.vault.local.azurestack.external/, got vault URL: %v", kvClient.GetVaultURL())
+	}
+
+	// managed hsm endpoints are not defined in the environment file
+	if _, err = NewKeyVaultClient(cfg, "testkv", "key1", "262067a9e8ba401aa8a746c5f1a7e147", false, "", 0, true, nil, nil, ""); err == nil {
+		t.Fatalf("newKeyVaultClient() expected error for managed hsm, got nil")
+	}
+}
+
+func TestKeyVaultClientProxyModeOverTLS(t *testing.T) {
+	keyID := "https://testkv.vault.azure.net/keys/key1/262067a9e8ba401aa8a746c5f1a7e147"
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get(consts.RequestHeaderTargetType) {
+		case consts.TargetTypeAzureActiveDirectory:
+			fmt.Fprintf(w, `{"access_token":"token","token_type":"Bearer","expires_in":"3600","expires_on":"%d","resource":"https://vault.azure.net"}`,
+				time.Now().Add(time.Hour).Unix())
+		case consts.TargetTypeKeyVault:
+			if !strings.HasPrefix(r.URL.Path, "/testkv.vault.azure.net/") || r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"kid":%q,"value":"Y2lwaGVy"}`, keyID)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	trustedCert, trustedCA := newTestClientCertificate(t, "kms-plugin")
+	untrustedCert, _ := newTestClientCertificate(t, "untrusted")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(trustedCA)
+	proxy.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MinVersion: tls.VersionTLS12}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy url: %v", err)
+	}
+	proxyPort, err := strconv.Atoi(proxyURL.Port())
+	if err != nil {
+		t.Fatalf("failed to parse proxy port: %v", err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(proxy.Certificate())
+	proxyTLSConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		RootCAs:      rootCAs,
+		Certificates: []tls.Certificate{trustedCert},
+	}
+
+	cfg := &config.AzureConfig{TenantID: "tenant", ClientID: "clientid", ClientSecret: "clientsecret"}
+	kvClient, err := NewKeyVaultClient(cfg, "testkv", "key1", "262067a9e8ba401aa8a746c5f1a7e147", true, proxyURL.Hostname(), proxyPort, false, proxyTLSConfig, nil, "")
+	if err != nil {
+		t.Fatalf("newKeyVaultClient() failed with error: %v", err)
+	}
+
+	encryptResponse, err := kvClient.Encrypt(context.TODO(), []byte("foo"), keyvault.RSAOAEP256)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if string(encryptResponse.Ciphertext) != "Y2lwaGVy" {
+		t.Fatalf("expected ciphertext: Y2lwaGVy, got: %s", string(encryptResponse.Ciphertext))
+	}
+
+	// the proxy requires a client certificate signed by its client CA
+	tests := []struct {
+		desc        string
+		certificate *tls.Certificate
+	}{
+		{
+			desc:        "no client certificate",
+			certificate: &tls.Certificate{},
+		},
+		{
+			desc:        "untrusted client certificate",
+			certificate: &untrustedCert,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			proxyTLSConfig := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				RootCAs:    rootCAs,
+				// send the certificate even though it is not signed by a CA the proxy accepts
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return test.certificate, nil
+				},
+			}
+			kvClient, err := NewKeyVaultClient(cfg, "testkv", "key1", "262067a9e8ba401aa8a746c5f1a7e147", true, proxyURL.Hostname(), proxyPort, false, proxyTLSConfig, nil, "")
+			if err != nil {
+				t.Fatalf("newKeyVaultClient() failed with error: %v", err)
+			}
+			// the failed request is retried with backoff until the context is done
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if _, err = kvClient.Encrypt(ctx, []byte("foo"), keyvault.RSAOAEP256); err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+		})
+	}
+}
+
+// newTestClientCertificate returns a self-signed client certificate, which is also its own CA.
+func newTestClientCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestKeyVaultClientWithHTTPProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	var mu sync.Mutex
+	var connectTargets []string
+	forwardProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		connectTargets = append(connectTargets, r.Host)
+		// refuse the tunnel, only the CONNECT request is verified
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forwardProxy.Close()
+
+	proxyURL, err := url.Parse(forwardProxy.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy url: %v", err)
+	}
+	proxyURL.User = url.UserPassword("user", "pass")
+
+	cfg := &config.AzureConfig{TenantID: "tenant", ClientID: "clientid", ClientSecret: "clientsecret"}
+	kvClient, err := NewKeyVaultClient(cfg, "testkv", "key1", "262067a9e8ba401aa8a746c5f1a7e147", false, "", 0, false, nil, &utils.HTTPProxyConfig{
+		HTTPSProxy: proxyURL.String(),
+	}, "")
+	if err != nil {
+		t.Fatalf("newKeyVaultClient() failed with error: %v", err)
+	}
+	if kvClient.GetVaultURL() != "https://testkv.vault.azure.net/" {
+		t.Fatalf("expected vault URL: https://testkv.vault.azure.net/, got vault URL: %v", kvClient.GetVaultURL())
+	}
+
+	// the failed request is retried with backoff until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err = kvClient.Encrypt(ctx, []byte("foo"), keyvault.RSAOAEP256); err == nil {
+		t.Fatalf("expected error when the proxy refuses the tunnel, got nil")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(connectTargets) == 0 || connectTargets[0] != "login.microsoftonline.com:443" {
+		t.Fatalf("expected token request to be tunneled to login.microsoftonline.com:443, got: %v", connectTargets)
+	}
+}
+
+func TestGetVaultResourceIdentifier(t *testing.T) {
+	customEnv := &azure.Environment{
+		ResourceIdentifiers: azure.ResourceIdentifier{
+			KeyVault: "https://vault.local.azurestack.external/",
+		},
+	}
+
+	tests := []struct {
+		desc             string
+		env              *azure.Environment
+		managedHSM       bool
+		adfs             bool
+		expectedResource string
+	}{
+		{
+			desc:             "public cloud key vault",
+			env:              &azure.PublicCloud,
+			expectedResource: "https://vault.azure.net",
+		},
+		{
+			desc:             "public cloud managed hsm",
+			env:              &azure.PublicCloud,
+			managedHSM:       true,
+			expectedResource: "https://managedhsm.azure.net",
+		},
+		{
+			desc:             "custom environment key vault",
+			env:              customEnv,
+			expectedResource: "https://vault.local.azurestack.external/",
+		},
+		{
+			desc:             "custom environment key vault with adfs",
+			env:              customEnv,
+			adfs:             true,
+			expectedResource: "https://vault.local.azurestack.external",
+		},
+		{
+			desc:             "custom environment without managed hsm",
+			env:              customEnv,
+			managedHSM:       true,
+			expectedResource: azure.NotAvailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			resource := getVaultResourceIdentifier(test.managedHSM, test.env, test.adfs)
+			if resource != test.expectedResource {
+				t.Fatalf("expected resource identifier: %s, got: %s", test.expectedResource, resource)
+			}
+		})
+	}
+}
+
 func TestGetKeyIDHash(t *testing.T) {
 	testCases := []struct {
 		name                string
@@ -0,0 +1,66 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"monis.app/mlog"
+)
+
+// v1DecryptUsage counts the decrypt requests on the kms v1 API. Once all data encrypted
+// with kms v1 is migrated, the count stays at zero and kms v1 can be disabled.
+type v1DecryptUsage struct {
+	reporter metrics.V1UsageReporter
+
+	decrypts    atomic.Uint64
+	failures    atomic.Uint64
+	lastDecrypt atomic.Int64
+}
+
+func (u *v1DecryptUsage) record(ctx context.Context, err error) {
+	if u == nil || isHealthCheck(ctx) {
+		return
+	}
+	status := metrics.SuccessStatusTypeValue
+	if err != nil {
+		status = metrics.ErrorStatusTypeValue
+		u.failures.Add(1)
+	}
+	u.decrypts.Add(1)
+	u.lastDecrypt.Store(time.Now().Unix())
+	u.reporter.ReportV1Decrypt(ctx, status)
+}
+
+// summarize returns the number of decrypts and failures since the last summary.
+func (u *v1DecryptUsage) summarize() (decrypts, failures uint64) {
+	return u.decrypts.Swap(0), u.failures.Swap(0)
+}
+
+// LogV1DecryptUsage logs the number of kms v1 decrypt requests every interval until ctx is done.
+func (s *KeyManagementServiceServer) LogV1DecryptUsage(ctx context.Context, interval time.Duration, provider string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		decrypts, failures := s.usage.summarize()
+		lastDecrypt := "never"
+		if last := s.usage.lastDecrypt.Load(); last != 0 {
+			lastDecrypt = time.Unix(last, 0).UTC().Format(time.RFC3339)
+		}
+		mlog.Always("kms v1 decrypt usage", "provider", provider, "interval", interval,
+			"decrypts", decrypts, "failures", failures, "lastDecrypt", lastDecrypt)
+	}
+}
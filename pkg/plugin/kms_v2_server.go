@@ -8,6 +8,7 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/metrics"
@@ -23,7 +24,14 @@ type KeyManagementServiceV2Server struct {
 	kmsv2.UnimplementedKeyManagementServiceServer
 	kvClient            Client
 	reporter            metrics.StatsReporter
+	statusCache         *statusCache
+	statusMu            sync.Mutex
+	statusCall          *statusCall
 	encryptionAlgorithm keyvault.JSONWebKeyEncryptionAlgorithm
+	// StatusProbeTimeout is the timeout of the Key Vault probes of Status, defaultStatusProbeTimeout if 0.
+	StatusProbeTimeout time.Duration
+	// ExcludeProbesFromAuditLog skips the request logs of health checks, so only the requests of kube-apiserver are logged.
+	ExcludeProbesFromAuditLog bool
 }
 
 // NewKMSv2Server creates an instance of the KMS Service Server with v2 apis.
@@ -40,66 +48,45 @@ func NewKMSv2Server(kvClient Client) (*KeyManagementServiceV2Server, error) {
 	}, nil
 }
 
-// Status returns the health status of the KMS plugin.
+// Status returns the health status of the KMS plugin. A degraded Key Vault is reported
+// in Healthz rather than as an error, so kube-apiserver can tell it from an unreachable plugin.
 func (s *KeyManagementServiceV2Server) Status(ctx context.Context, _ *kmsv2.StatusRequest) (*kmsv2.StatusResponse, error) {
-	// We perform a simple encrypt/decrypt operation to verify the plugin's connectivity with Key Vault.
+	// Without the status prober, we perform a simple encrypt/decrypt operation on every call.
 	// The KMS invokes the Status API every minute, resulting in 120 calls per hour to the Key Vault.
 	// This volume of calls is well within the permissible limit of Key Vault.
-	encryptResponse, err := s.kvClient.Encrypt(ctx, []byte(healthCheckPlainText), s.encryptionAlgorithm)
-	if err != nil {
-		mlog.Error("failed to encrypt healthcheck call", err)
-		return nil, err
+	var probe *statusProbe
+	if s.statusCache != nil {
+		probe = s.statusCache.get(time.Now())
 	}
-
-	decryptedText, err := s.kvClient.Decrypt(
-		ctx,
-		encryptResponse.Ciphertext,
-		s.encryptionAlgorithm,
-		version.KMSv2APIVersion,
-		encryptResponse.Annotations,
-		encryptResponse.KeyID,
-	)
-	if err != nil {
-		mlog.Error("failed to decrypt healthcheck call", err)
-		return nil, err
-	}
-
-	if string(decryptedText) != healthCheckPlainText {
-		err = fmt.Errorf("decrypted text does not match")
-		mlog.Error("healthcheck failed", err)
-		return nil, err
+	if probe == nil {
+		probe = s.sharedProbeStatus(ctx)
 	}
 
+	// the configured key id is returned while degraded, so kube-apiserver does not see a key rotation
 	return &kmsv2.StatusResponse{
 		Version: version.KMSv2APIVersion,
-		Healthz: "ok",
-		KeyId:   encryptResponse.KeyID,
+		Healthz: probe.healthz(),
+		KeyId:   s.kvClient.GetKeyID(),
 	}, nil
 }
 
 // Encrypt message.
 func (s *KeyManagementServiceV2Server) Encrypt(ctx context.Context, request *kmsv2.EncryptRequest) (*kmsv2.EncryptResponse, error) {
-	mlog.Debug("encrypt request received", "uid", request.Uid)
+	mlog.Debug("encrypt request received", "uid", request.Uid, "origin", metrics.Origin(ctx))
 	start := time.Now()
 
 	var err error
 	defer func() {
-		errors := ""
-		status := metrics.SuccessStatusTypeValue
-		if err != nil {
-			status = metrics.ErrorStatusTypeValue
-			errors = err.Error()
-		}
-		s.reporter.ReportRequest(ctx, metrics.EncryptOperationTypeValue, status, time.Since(start).Seconds(), errors)
+		s.reporter.ReportRequest(ctx, metrics.EncryptOperationTypeValue, time.Since(start).Seconds(), err)
 	}()
 
-	mlog.Info("encrypt request started", "uid", request.Uid)
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "encrypt request started", "uid", request.Uid)
 	encryptResponse, err := s.kvClient.Encrypt(ctx, request.Plaintext, s.encryptionAlgorithm)
 	if err != nil {
-		mlog.Error("failed to encrypt", err, "uid", request.Uid)
+		mlog.Error("failed to encrypt", err, "uid", request.Uid, "origin", metrics.Origin(ctx))
 		return &kmsv2.EncryptResponse{}, err
 	}
-	mlog.Info("encrypt request complete", "uid", request.Uid)
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "encrypt request complete", "uid", request.Uid)
 
 	return &kmsv2.EncryptResponse{
 		Ciphertext:  encryptResponse.Ciphertext,
@@ -110,21 +97,15 @@ func (s *KeyManagementServiceV2Server) Encrypt(ctx context.Context, request *kms
 
 // Decrypt message.
 func (s *KeyManagementServiceV2Server) Decrypt(ctx context.Context, request *kmsv2.DecryptRequest) (*kmsv2.DecryptResponse, error) {
-	mlog.Debug("decrypt request received", "uid", request.Uid)
+	mlog.Debug("decrypt request received", "uid", request.Uid, "origin", metrics.Origin(ctx))
 	start := time.Now()
 
 	var err error
 	defer func() {
-		errors := ""
-		status := metrics.SuccessStatusTypeValue
-		if err != nil {
-			status = metrics.ErrorStatusTypeValue
-			errors = err.Error()
-		}
-		s.reporter.ReportRequest(ctx, metrics.DecryptOperationTypeValue, status, time.Since(start).Seconds(), errors)
+		s.reporter.ReportRequest(ctx, metrics.DecryptOperationTypeValue, time.Since(start).Seconds(), err)
 	}()
 
-	mlog.Info("decrypt request started", "uid", request.Uid)
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "decrypt request started", "uid", request.Uid)
 
 	plainText, err := s.kvClient.Decrypt(
 		ctx,
@@ -135,10 +116,10 @@ func (s *KeyManagementServiceV2Server) Decrypt(ctx context.Context, request *kms
 		request.KeyId,
 	)
 	if err != nil {
-		mlog.Error("failed to decrypt", err, "uid", request.Uid)
+		mlog.Error("failed to decrypt", err, "uid", request.Uid, "origin", metrics.Origin(ctx))
 		return &kmsv2.DecryptResponse{}, err
 	}
-	mlog.Info("decrypt request complete", "uid", request.Uid)
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "decrypt request complete", "uid", request.Uid)
 
 	return &kmsv2.DecryptResponse{
 		Plaintext: plainText,
@@ -10,7 +10,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
 	"github.com/Azure/kubernetes-kms/pkg/metrics"
@@ -18,6 +22,7 @@ import (
 
 	"github.com/Azure/kubernetes-kms/pkg/version"
 	kmsv2 "k8s.io/kms/apis/v2"
+	"k8s.io/kms/pkg/service"
 )
 
 func TestV2Encrypt(t *testing.T) {
@@ -178,28 +183,205 @@ func TestV2Decrypt(t *testing.T) {
 }
 
 func TestStatus(t *testing.T) {
-	kmsServer := KeyManagementServiceV2Server{}
+	tests := []struct {
+		desc            string
+		setEncryptError error
+		expectedHealthz string
+		expectedKeyID   string
+	}{
+		{
+			desc:            "healthy",
+			expectedHealthz: "ok",
+			expectedKeyID:   "mock-key-id",
+		},
+		{
+			desc:            "degraded",
+			setEncryptError: fmt.Errorf("key vault unavailable"),
+			expectedHealthz: "degraded: encrypt: unknown",
+			expectedKeyID:   "mock-key-id",
+		},
+		{
+			desc:            "degraded with classified error",
+			setEncryptError: fmt.Errorf("failed to encrypt, error: %w", ErrThrottled),
+			expectedHealthz: "degraded: encrypt: throttled",
+			expectedKeyID:   "mock-key-id",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			kmsServer := KeyManagementServiceV2Server{}
+			mockKeyVaultClient := &mockkeyvault.KeyVaultClient{
+				KeyID: "mock-key-id",
+			}
+			mockKeyVaultClient.SetEncryptResponse([]byte(healthCheckPlainText), test.setEncryptError)
+			mockKeyVaultClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+			kmsServer.kvClient = mockKeyVaultClient
+
+			v, err := kmsServer.Status(context.TODO(), &kmsv2.StatusRequest{})
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			if v.Version != version.KMSv2APIVersion {
+				t.Fatalf("expected version: %s, got: %s", version.KMSv2APIVersion, v.Version)
+			}
+
+			if v.Healthz != test.expectedHealthz {
+				t.Fatalf("expected healthz response to be: %s, got: %s", test.expectedHealthz, v.Healthz)
+			}
+
+			if v.KeyId != test.expectedKeyID {
+				t.Fatalf("expected key id: %s, got: %s", test.expectedKeyID, v.KeyId)
+			}
+		})
+	}
+}
+
+func TestStatusCache(t *testing.T) {
 	mockKeyVaultClient := &mockkeyvault.KeyVaultClient{
 		KeyID: "mock-key-id",
 	}
 	mockKeyVaultClient.SetEncryptResponse([]byte(healthCheckPlainText), nil)
 	mockKeyVaultClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
-	kmsServer.kvClient = mockKeyVaultClient
+	kmsServer := KeyManagementServiceV2Server{
+		kvClient:    mockKeyVaultClient,
+		statusCache: &statusCache{maxStaleness: time.Minute},
+	}
 
+	// the first call probes inline and fills the cache
 	v, err := kmsServer.Status(context.TODO(), &kmsv2.StatusRequest{})
 	if err != nil {
 		t.Fatalf("expected err to be nil, got: %v", err)
 	}
-
-	if v.Version != version.KMSv2APIVersion {
-		t.Fatalf("expected version: %s, got: %s", version.KMSv2APIVersion, v.Version)
+	if v.Healthz != "ok" {
+		t.Fatalf("expected healthz response to be: %s, got: %s", "ok", v.Healthz)
 	}
 
+	// later calls are served from the cache while it is fresh
+	mockKeyVaultClient.SetEncryptResponse(nil, fmt.Errorf("key vault unavailable"))
+	v, err = kmsServer.Status(context.TODO(), &kmsv2.StatusRequest{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
 	if v.Healthz != "ok" {
-		t.Fatalf("expected healthz response to be: %s, got: %s", "ok", v.Healthz)
+		t.Fatalf("expected cached healthz response to be: %s, got: %s", "ok", v.Healthz)
 	}
 
+	// a stale probe is replaced, and the last known key id is kept while degraded
+	kmsServer.statusCache.probe.time = time.Now().Add(-2 * time.Minute)
+	v, err = kmsServer.Status(context.TODO(), &kmsv2.StatusRequest{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if !strings.HasPrefix(v.Healthz, "degraded: ") {
+		t.Fatalf("expected degraded healthz response, got: %s", v.Healthz)
+	}
 	if v.KeyId != "mock-key-id" {
 		t.Fatalf("expected key id: %s, got: %s", "mock-key-id", v.KeyId)
 	}
 }
+
+// blockingKeyVaultClient blocks Encrypt until release is closed or ctx is done, and counts the calls.
+type blockingKeyVaultClient struct {
+	*mockkeyvault.KeyVaultClient
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (c *blockingKeyVaultClient) Encrypt(ctx context.Context, plain []byte, encryptionAlgorithm keyvault.JSONWebKeyEncryptionAlgorithm) (*service.EncryptResponse, error) {
+	c.calls.Add(1)
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.KeyVaultClient.Encrypt(ctx, plain, encryptionAlgorithm)
+}
+
+func TestStatusSingleFlight(t *testing.T) {
+	mockKeyVaultClient := &mockkeyvault.KeyVaultClient{
+		KeyID: "mock-key-id",
+	}
+	mockKeyVaultClient.SetEncryptResponse([]byte(healthCheckPlainText), nil)
+	mockKeyVaultClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+	kvClient := &blockingKeyVaultClient{KeyVaultClient: mockKeyVaultClient, release: make(chan struct{})}
+	kmsServer := KeyManagementServiceV2Server{
+		kvClient:    kvClient,
+		statusCache: &statusCache{maxStaleness: time.Minute},
+	}
+
+	// concurrent calls without a fresh probe share a single inline probe
+	const concurrentCalls = 5
+	var wg sync.WaitGroup
+	responses := make(chan *kmsv2.StatusResponse, concurrentCalls)
+	for i := 0; i < concurrentCalls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := kmsServer.Status(context.TODO(), &kmsv2.StatusRequest{})
+			if err != nil {
+				t.Errorf("expected err to be nil, got: %v", err)
+				return
+			}
+			responses <- v
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(kvClient.release)
+	wg.Wait()
+	close(responses)
+
+	if calls := kvClient.calls.Load(); calls != 1 {
+		t.Fatalf("expected 1 encrypt call, got: %d", calls)
+	}
+	for v := range responses {
+		if v.Healthz != "ok" {
+			t.Fatalf("expected healthz response to be: %s, got: %s", "ok", v.Healthz)
+		}
+	}
+}
+
+func TestStatusFirstCallerCanceled(t *testing.T) {
+	mockKeyVaultClient := &mockkeyvault.KeyVaultClient{
+		KeyID: "mock-key-id",
+	}
+	mockKeyVaultClient.SetEncryptResponse([]byte(healthCheckPlainText), nil)
+	mockKeyVaultClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+	kvClient := &blockingKeyVaultClient{KeyVaultClient: mockKeyVaultClient, release: make(chan struct{})}
+	kmsServer := KeyManagementServiceV2Server{
+		kvClient:    kvClient,
+		statusCache: &statusCache{maxStaleness: time.Minute},
+	}
+
+	// the caller that starts the probe gives up before Key Vault responds
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	v, err := kmsServer.Status(ctx, &kmsv2.StatusRequest{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if !strings.HasPrefix(v.Healthz, "degraded: wait for probe: ") {
+		t.Fatalf("expected the canceled caller to stop waiting, got healthz: %s", v.Healthz)
+	}
+
+	// the probe is not canceled with the first caller, so the next caller gets its result
+	close(kvClient.release)
+	v, err = kmsServer.Status(context.TODO(), &kmsv2.StatusRequest{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if v.Healthz != healthzOK {
+		t.Fatalf("expected healthz: %s, got: %s", healthzOK, v.Healthz)
+	}
+	if calls := kvClient.calls.Load(); calls != 1 {
+		t.Fatalf("expected 1 encrypt call, got: %d", calls)
+	}
+	// the cached probe is the successful one
+	if probe := kmsServer.statusCache.get(time.Now()); probe == nil || probe.err != nil {
+		t.Fatalf("expected a successful cached probe, got: %+v", probe)
+	}
+}
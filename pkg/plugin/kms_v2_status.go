@@ -0,0 +1,196 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+	"github.com/Azure/kubernetes-kms/pkg/version"
+
+	"monis.app/mlog"
+)
+
+const (
+	healthzOK = "ok"
+	// defaultStatusProbeTimeout is the timeout of the Status probes when StatusProbeTimeout is not set.
+	defaultStatusProbeTimeout = 20 * time.Second
+)
+
+// statusProbe is the result of an encrypt and decrypt roundtrip with Key Vault.
+type statusProbe struct {
+	// reason is the bounded reason of a failed probe reported in Healthz, e.g. "encrypt: throttled".
+	// The error itself is only logged, since it can be long and contain details of the Key Vault response.
+	reason string
+	err    error
+	time   time.Time
+}
+
+// healthz returns the Healthz of the kms v2 StatusResponse for the probe.
+func (p *statusProbe) healthz() string {
+	if p.err != nil {
+		return "degraded: " + p.reason
+	}
+	return healthzOK
+}
+
+func (p *statusProbe) fail(operation string, err error) {
+	p.reason = operation + ": " + metrics.ErrorReason(err)
+	p.err = fmt.Errorf("failed to %s: %w", operation, err)
+	mlog.Error("status probe failed", p.err, "origin", metrics.OriginStatusProbe)
+}
+
+// statusCall is a probe in flight. Status calls that need a probe while one is in flight wait
+// for its result instead of calling Key Vault themselves.
+type statusCall struct {
+	done  chan struct{}
+	probe *statusProbe
+}
+
+// statusCache holds the latest status probe, so Status does not call Key Vault on every request.
+type statusCache struct {
+	maxStaleness time.Duration
+
+	mu    sync.RWMutex
+	probe *statusProbe
+}
+
+func (c *statusCache) get(now time.Time) *statusProbe {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.probe == nil || now.Sub(c.probe.time) > c.maxStaleness {
+		return nil
+	}
+	return c.probe
+}
+
+func (c *statusCache) set(probe *statusProbe) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probe = probe
+}
+
+// StartStatusProber probes Key Vault every interval until ctx is done, and serves Status from
+// the latest probe. Status probes inline when there is no probe younger than maxStaleness,
+// e.g. before the first probe completes or when the prober is stuck. Every probe, inline
+// probes included, times out after timeout.
+// It must be called before the server serves requests.
+func (s *KeyManagementServiceV2Server) StartStatusProber(ctx context.Context, interval, timeout, maxStaleness time.Duration) {
+	s.statusCache = &statusCache{maxStaleness: maxStaleness}
+	s.StatusProbeTimeout = timeout
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			s.sharedProbeStatus(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// hasStatusProber returns true if StartStatusProber was called.
+func (s *KeyManagementServiceV2Server) hasStatusProber() bool {
+	return s.statusCache != nil
+}
+
+// latestStatusProbeError returns the error of the latest probe of the status prober, or an error
+// if there is no probe younger than maxStaleness. It never calls Key Vault.
+func (s *KeyManagementServiceV2Server) latestStatusProbeError() error {
+	probe := s.statusCache.get(time.Now())
+	if probe == nil {
+		return fmt.Errorf("no status probe within %s", s.statusCache.maxStaleness)
+	}
+	return probe.err
+}
+
+// sharedProbeStatus probes Key Vault and stores the result in the cache, or waits for the
+// result of the probe in flight, so a slow Key Vault is not probed by every Status call.
+// The probe does not run with the context of the caller that started it, so its cancellation
+// is not the result of the other callers; a caller whose ctx is done stops waiting.
+func (s *KeyManagementServiceV2Server) sharedProbeStatus(ctx context.Context) *statusProbe {
+	s.statusMu.Lock()
+	call := s.statusCall
+	if call == nil {
+		call = &statusCall{done: make(chan struct{})}
+		s.statusCall = call
+		go s.runStatusCall(context.WithoutCancel(ctx), call)
+	}
+	s.statusMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.probe
+	case <-ctx.Done():
+		probe := &statusProbe{time: time.Now()}
+		probe.fail("wait for probe", ctx.Err())
+		return probe
+	}
+}
+
+// runStatusCall probes Key Vault within StatusProbeTimeout and completes call.
+func (s *KeyManagementServiceV2Server) runStatusCall(ctx context.Context, call *statusCall) {
+	timeout := s.StatusProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultStatusProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	call.probe = s.probeStatus(ctx)
+	// a canceled probe, e.g. on shutdown, says nothing about Key Vault
+	if s.statusCache != nil && !errors.Is(call.probe.err, context.Canceled) {
+		s.statusCache.set(call.probe)
+	}
+
+	s.statusMu.Lock()
+	s.statusCall = nil
+	s.statusMu.Unlock()
+	close(call.done)
+}
+
+// probeStatus encrypts and decrypts test data to verify the plugin's connectivity with Key Vault.
+func (s *KeyManagementServiceV2Server) probeStatus(ctx context.Context) *statusProbe {
+	ctx = metrics.WithOrigin(ctx, metrics.OriginStatusProbe)
+	probe := &statusProbe{}
+	defer func() {
+		probe.time = time.Now()
+	}()
+
+	encryptResponse, err := s.kvClient.Encrypt(ctx, []byte(healthCheckPlainText), s.encryptionAlgorithm)
+	if err != nil {
+		probe.fail("encrypt", err)
+		return probe
+	}
+
+	decryptedText, err := s.kvClient.Decrypt(
+		ctx,
+		encryptResponse.Ciphertext,
+		s.encryptionAlgorithm,
+		version.KMSv2APIVersion,
+		encryptResponse.Annotations,
+		encryptResponse.KeyID,
+	)
+	if err != nil {
+		probe.fail("decrypt", err)
+		return probe
+	}
+
+	if string(decryptedText) != healthCheckPlainText {
+		probe.reason = "decrypt: plaintext mismatch"
+		probe.err = fmt.Errorf("decrypted text does not match")
+		mlog.Error("status probe failed", probe.err, "origin", metrics.OriginStatusProbe)
+	}
+	return probe
+}
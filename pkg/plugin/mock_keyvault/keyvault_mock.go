@@ -17,17 +17,21 @@ import (
 type KeyVaultClient struct {
 	mutex sync.Mutex
 
-	encryptOut []byte
-	encryptErr error
-	decryptOut []byte
-	decryptErr error
-	KeyID      string
-	Algorithm  keyvault.JSONWebKeyEncryptionAlgorithm
+	encryptOut   []byte
+	encryptErr   error
+	encryptCalls int
+	decryptOut   []byte
+	decryptErr   error
+	tokenErr     error
+	keyErr       error
+	KeyID        string
+	Algorithm    keyvault.JSONWebKeyEncryptionAlgorithm
 }
 
 func (kvc *KeyVaultClient) Encrypt(_ context.Context, _ []byte, _ keyvault.JSONWebKeyEncryptionAlgorithm) (*service.EncryptResponse, error) {
 	kvc.mutex.Lock()
 	defer kvc.mutex.Unlock()
+	kvc.encryptCalls++
 	return &service.EncryptResponse{
 		Ciphertext: kvc.encryptOut,
 		KeyID:      kvc.KeyID,
@@ -45,6 +49,37 @@ func (kvc *KeyVaultClient) Decrypt(_ context.Context, _ []byte, _ keyvault.JSONW
 	return kvc.decryptOut, kvc.decryptErr
 }
 
+func (kvc *KeyVaultClient) CheckToken(_ context.Context) error {
+	kvc.mutex.Lock()
+	defer kvc.mutex.Unlock()
+	return kvc.tokenErr
+}
+
+func (kvc *KeyVaultClient) CheckKey(_ context.Context) error {
+	kvc.mutex.Lock()
+	defer kvc.mutex.Unlock()
+	return kvc.keyErr
+}
+
+func (kvc *KeyVaultClient) SetCheckTokenError(err error) {
+	kvc.mutex.Lock()
+	defer kvc.mutex.Unlock()
+	kvc.tokenErr = err
+}
+
+func (kvc *KeyVaultClient) SetCheckKeyError(err error) {
+	kvc.mutex.Lock()
+	defer kvc.mutex.Unlock()
+	kvc.keyErr = err
+}
+
+// EncryptCalls returns the number of Encrypt calls.
+func (kvc *KeyVaultClient) EncryptCalls() int {
+	kvc.mutex.Lock()
+	defer kvc.mutex.Unlock()
+	return kvc.encryptCalls
+}
+
 func (kvc *KeyVaultClient) SetEncryptResponse(encryptOut []byte, err error) {
 	kvc.mutex.Lock()
 	defer kvc.mutex.Unlock()
@@ -97,3 +132,7 @@ func (kvc *KeyVaultClient) GetUserAgent() string {
 func (kvc *KeyVaultClient) GetVaultURL() string {
 	return "https://test.vault.azure.net"
 }
+
+func (kvc *KeyVaultClient) GetKeyID() string {
+	return kvc.KeyID
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type requestIDRecorderContextKey struct{}
+
+// requestIDRecorder records the Key Vault request id of the last response received with its context.
+type requestIDRecorder struct {
+	mu        sync.Mutex
+	requestID string
+}
+
+// withRequestIDRecorder returns a context that records the Key Vault request ids of the requests made with it.
+func withRequestIDRecorder(ctx context.Context) (context.Context, *requestIDRecorder) {
+	recorder := &requestIDRecorder{}
+	return context.WithValue(ctx, requestIDRecorderContextKey{}, recorder), recorder
+}
+
+func (r *requestIDRecorder) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requestID
+}
+
+// recordRequestID records the request id of resp if ctx has a recorder. resp may be nil, e.g. if the request was not sent.
+func recordRequestID(ctx context.Context, resp *http.Response) {
+	recorder, ok := ctx.Value(requestIDRecorderContextKey{}).(*requestIDRecorder)
+	if !ok || resp == nil {
+		return
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.requestID = resp.Header.Get(requestIDAnnotationValue)
+}
@@ -8,9 +8,11 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/metrics"
+	"github.com/Azure/kubernetes-kms/pkg/utils"
 	"github.com/Azure/kubernetes-kms/pkg/version"
 
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
@@ -23,7 +25,10 @@ type KeyManagementServiceServer struct {
 	kmsv1.UnimplementedKeyManagementServiceServer
 	kvClient            Client
 	reporter            metrics.StatsReporter
+	usage               *v1DecryptUsage
 	encryptionAlgorithm keyvault.JSONWebKeyEncryptionAlgorithm
+	// ExcludeProbesFromAuditLog skips the request logs of health checks, so only the requests of kube-apiserver are logged.
+	ExcludeProbesFromAuditLog bool
 }
 
 // Config is the configuration for the KMS plugin.
@@ -32,10 +37,56 @@ type Config struct {
 	KeyVaultName   string
 	KeyName        string
 	KeyVersion     string
-	ManagedHSM     bool
-	ProxyMode      bool
-	ProxyAddress   string
-	ProxyPort      int
+	// VaultURL is used instead of KeyVaultName for vaults that are not reachable at
+	// https://<KeyVaultName>.<dns suffix>/. KeyID sets the vault url, key name and key version at once.
+	VaultURL     string
+	KeyID        string
+	ManagedHSM   bool
+	ProxyMode    bool
+	ProxyAddress string
+	ProxyPort    int
+
+	// SocketMode, SocketUID and SocketGID set the permission and owner of the unix socket.
+	SocketMode os.FileMode
+	SocketUID  int
+	SocketGID  int
+	// AllowedPeers authorizes the processes calling the plugin on the unix socket by their peer credentials.
+	AllowedPeers utils.PeerAllowlist
+
+	// ProxyTLS enables TLS to the proxy in proxy mode. The proxy server certificate is verified
+	// against ProxyCAFile and ProxyServerName, and the client certificate is presented for mTLS.
+	ProxyTLS            bool
+	ProxyCAFile         string
+	ProxyClientCertFile string
+	ProxyClientKeyFile  string
+	ProxyServerName     string
+
+	// HTTPSProxy, NoProxy and HTTPSProxyCredentialsFile configure a standard forward proxy.
+	// They override the HTTPS_PROXY and NO_PROXY environment variables and cannot be used with proxy mode.
+	HTTPSProxy                string
+	NoProxy                   string
+	HTTPSProxyCredentialsFile string
+
+	// TLSCertFile, TLSKeyFile and TLSClientCAFile are required when listening on tcp. Clients must
+	// present a certificate signed by TLSClientCAFile, with a subject in TLSAllowedClientSubjects if set.
+	TLSCertFile              string
+	TLSKeyFile               string
+	TLSClientCAFile          string
+	TLSAllowedClientSubjects []string
+
+	// HealthzTLSCAFile, HealthzTLSClientCertFile, HealthzTLSClientKeyFile and HealthzTLSServerName
+	// configure the connection from the health check to the gRPC server when listening on tcp.
+	HealthzTLSCAFile         string
+	HealthzTLSClientCertFile string
+	HealthzTLSClientKeyFile  string
+	HealthzTLSServerName     string
+
+	// EnableKMSv1 and EnableKMSv2 register the kms v1 and v2 services on the gRPC server.
+	EnableKMSv1 bool
+	EnableKMSv2 bool
+
+	// GRPCLimits bounds the message sizes, keepalive pings, streams and connection setup of the gRPC server.
+	GRPCLimits utils.GRPCServerLimits
 }
 
 // NewKMSv1Server creates an instance of the KMS Service Server.
@@ -44,10 +95,15 @@ func NewKMSv1Server(kvClient Client) (*KeyManagementServiceServer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create stats reporter: %w", err)
 	}
+	usageReporter, err := metrics.NewV1UsageReporter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kms v1 usage reporter: %w", err)
+	}
 
 	return &KeyManagementServiceServer{
 		kvClient:            kvClient,
 		reporter:            statsReporter,
+		usage:               &v1DecryptUsage{reporter: usageReporter},
 		encryptionAlgorithm: keyvault.RSA15,
 	}, nil
 }
@@ -67,22 +123,16 @@ func (s *KeyManagementServiceServer) Encrypt(ctx context.Context, request *kmsv1
 
 	var err error
 	defer func() {
-		errors := ""
-		status := metrics.SuccessStatusTypeValue
-		if err != nil {
-			status = metrics.ErrorStatusTypeValue
-			errors = err.Error()
-		}
-		s.reporter.ReportRequest(ctx, metrics.EncryptOperationTypeValue, status, time.Since(start).Seconds(), errors)
+		s.reporter.ReportRequest(ctx, metrics.EncryptOperationTypeValue, time.Since(start).Seconds(), err)
 	}()
 
-	mlog.Info("encrypt request started")
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "encrypt request started")
 	encryptResponse, err := s.kvClient.Encrypt(ctx, request.Plain, s.encryptionAlgorithm)
 	if err != nil {
-		mlog.Error("failed to encrypt", err)
+		mlog.Error("failed to encrypt", err, "origin", metrics.Origin(ctx))
 		return &kmsv1.EncryptResponse{}, err
 	}
-	mlog.Info("encrypt request complete")
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "encrypt request complete")
 	return &kmsv1.EncryptResponse{
 		Cipher: encryptResponse.Ciphertext,
 	}, nil
@@ -94,16 +144,11 @@ func (s *KeyManagementServiceServer) Decrypt(ctx context.Context, request *kmsv1
 
 	var err error
 	defer func() {
-		errors := ""
-		status := metrics.SuccessStatusTypeValue
-		if err != nil {
-			status = metrics.ErrorStatusTypeValue
-			errors = err.Error()
-		}
-		s.reporter.ReportRequest(ctx, metrics.DecryptOperationTypeValue, status, time.Since(start).Seconds(), errors)
+		s.reporter.ReportRequest(ctx, metrics.DecryptOperationTypeValue, time.Since(start).Seconds(), err)
+		s.usage.record(ctx, err)
 	}()
 
-	mlog.Info("decrypt request started")
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "decrypt request started")
 	plain, err := s.kvClient.Decrypt(
 		ctx,
 		request.Cipher,
@@ -113,9 +158,19 @@ func (s *KeyManagementServiceServer) Decrypt(ctx context.Context, request *kmsv1
 		"",
 	)
 	if err != nil {
-		mlog.Error("failed to decrypt", err)
+		mlog.Error("failed to decrypt", err, "origin", metrics.Origin(ctx))
 		return &kmsv1.DecryptResponse{}, err
 	}
-	mlog.Info("decrypt request complete")
+	auditLog(ctx, s.ExcludeProbesFromAuditLog, "decrypt request complete")
 	return &kmsv1.DecryptResponse{Plain: plain}, nil
 }
+
+// auditLog logs a kms request with its origin. The requests of health checks and status probes
+// are skipped if excludeProbes is set.
+func auditLog(ctx context.Context, excludeProbes bool, msg string, keysAndValues ...interface{}) {
+	origin := metrics.Origin(ctx)
+	if excludeProbes && origin != metrics.OriginAPIServer {
+		return
+	}
+	mlog.Info(msg, append(keysAndValues, "origin", origin)...)
+}
@@ -136,3 +136,35 @@ func TestVersion(t *testing.T) {
 		t.Fatalf("expected runtime version: %s, got: %s", version.BuildVersion, v.Version)
 	}
 }
+
+func TestV1DecryptUsage(t *testing.T) {
+	kvClient := &mockkeyvault.KeyVaultClient{}
+	kvClient.SetEncryptResponse([]byte("bar"), nil)
+	kvClient.SetDecryptResponse([]byte(healthCheckPlainText), nil)
+
+	kmsServer, err := NewKMSv1Server(kvClient)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	if _, err := kmsServer.Decrypt(context.TODO(), &kmsv1.DecryptRequest{Cipher: []byte("bar")}); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	// health checks are not counted as kms v1 usage
+	if err := checkKMSv1(context.TODO(), kmsV1LocalClient{kmsServer}); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	decrypts, failures := kmsServer.usage.summarize()
+	if decrypts != 1 || failures != 0 {
+		t.Fatalf("expected 1 decrypt and 0 failures, got: %d decrypts and %d failures", decrypts, failures)
+	}
+	if kmsServer.usage.lastDecrypt.Load() == 0 {
+		t.Fatalf("expected last decrypt time to be set")
+	}
+
+	decrypts, _ = kmsServer.usage.summarize()
+	if decrypts != 0 {
+		t.Fatalf("expected decrypts to be reset after the summary, got: %d", decrypts)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+type upstreamAttemptsContextKey struct{}
+
+// upstreamAttempts counts the attempts of the requests sent to each target with its context, so the
+// retries of the Key Vault client and the token provider can be told apart from new requests.
+type upstreamAttempts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// withUpstreamAttempts returns a context that counts the attempts of the requests sent with it.
+// It is used for each call of the Key Vault client.
+func withUpstreamAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamAttemptsContextKey{}, &upstreamAttempts{counts: map[string]int{}})
+}
+
+// nextAttempt returns the number of the attempt of a request to target sent with ctx, starting at 1.
+// Requests sent with a context without counter are always the first attempt.
+func nextAttempt(ctx context.Context, target string) int {
+	attempts, ok := ctx.Value(upstreamAttemptsContextKey{}).(*upstreamAttempts)
+	if !ok {
+		return 1
+	}
+	attempts.mu.Lock()
+	defer attempts.mu.Unlock()
+	attempts.counts[target]++
+	return attempts.counts[target]
+}
+
+// countingBody counts the bytes read from a request or response body, since ContentLength is
+// unknown for chunked bodies. The response body reports the bytes read once it is closed.
+type countingBody struct {
+	io.ReadCloser
+	n       atomic.Int64
+	once    sync.Once
+	onClose func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.onClose != nil {
+		b.once.Do(func() { b.onClose(b.n.Load()) })
+	}
+	return err
+}
+
+// withUpstreamMetrics returns a send decorator that reports every attempt of the requests to target.
+// The latency is the time until the response headers are received, and the bytes received are
+// reported when the response body is closed.
+func withUpstreamMetrics(reporter metrics.UpstreamStatsReporter, target string) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			ctx := r.Context()
+			attempt := nextAttempt(ctx, target)
+			var sent *countingBody
+			if r.Body != nil && r.Body != http.NoBody {
+				// the body is replaced on a copy, so the retries of the caller still rewind the original request
+				sent = &countingBody{ReadCloser: r.Body}
+				r = r.WithContext(ctx)
+				r.Body = sent
+			}
+			start := time.Now()
+			resp, err := s.Do(r)
+
+			req := metrics.UpstreamRequest{
+				Target:   target,
+				Host:     r.URL.Host,
+				Retry:    attempt > 1,
+				Duration: time.Since(start).Seconds(),
+			}
+			if sent != nil {
+				req.SentBytes = sent.n.Load()
+			}
+			if resp != nil {
+				req.StatusCode = resp.StatusCode
+				req.Region = resp.Header.Get(keyvaultRegionAnnotationValue)
+				if resp.Body != nil {
+					resp.Body = &countingBody{ReadCloser: resp.Body, onClose: func(n int64) {
+						reporter.ReportUpstreamReceivedBytes(ctx, req, n)
+					}}
+				}
+			}
+			reporter.ReportUpstreamRequest(ctx, req)
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/consts"
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+type fakeUpstreamReporter struct {
+	mu            sync.Mutex
+	requests      []metrics.UpstreamRequest
+	receivedBytes []int64
+}
+
+func (r *fakeUpstreamReporter) ReportUpstreamRequest(_ context.Context, req metrics.UpstreamRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+func (r *fakeUpstreamReporter) ReportUpstreamReceivedBytes(_ context.Context, _ metrics.UpstreamRequest, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.receivedBytes = append(r.receivedBytes, n)
+}
+
+func TestUpstreamMetrics(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts++
+		w.Header().Set(keyvaultRegionAnnotationValue, "eastus")
+		if attempts == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"value":"foo"}`))
+	}))
+	defer server.Close()
+
+	reporter := &fakeUpstreamReporter{}
+	sender := autorest.DecorateSender(server.Client(), withUpstreamMetrics(reporter, consts.TargetTypeKeyVault))
+
+	req, err := http.NewRequestWithContext(withUpstreamAttempts(context.Background()), http.MethodPost, server.URL, strings.NewReader("bar"))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := autorest.SendWithSender(sender, req, autorest.DoRetryForStatusCodes(1, time.Millisecond, http.StatusTooManyRequests))
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	resp.Body.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	expected := []metrics.UpstreamRequest{
+		{Target: consts.TargetTypeKeyVault, Host: serverURL.Host, Region: "eastus", StatusCode: http.StatusTooManyRequests, SentBytes: 3},
+		{Target: consts.TargetTypeKeyVault, Host: serverURL.Host, Region: "eastus", StatusCode: http.StatusOK, Retry: true, SentBytes: 3},
+	}
+	if len(reporter.requests) != len(expected) {
+		t.Fatalf("expected %d requests, got: %+v", len(expected), reporter.requests)
+	}
+	for i, got := range reporter.requests {
+		if got.Duration <= 0 {
+			t.Fatalf("expected duration of request %d to be positive, got: %v", i, got.Duration)
+		}
+		got.Duration = 0
+		if got != expected[i] {
+			t.Fatalf("expected request %d: %+v, got: %+v", i, expected[i], got)
+		}
+	}
+	if expected := []int64{0, 15}; !reflect.DeepEqual(reporter.receivedBytes, expected) {
+		t.Fatalf("expected received bytes: %v, got: %v", expected, reporter.receivedBytes)
+	}
+}
+
+func TestUpstreamMetricsUnknownLength(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		// flushing before writing the body sends it chunked, without Content-Length
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(`{"value":"foo"}`))
+	}))
+	defer server.Close()
+
+	reporter := &fakeUpstreamReporter{}
+	sender := autorest.DecorateSender(server.Client(), withUpstreamMetrics(reporter, consts.TargetTypeKeyVault))
+
+	// the length of a body that is not a bytes or strings reader is unknown
+	req, err := http.NewRequest(http.MethodPost, server.URL, io.NopCloser(strings.NewReader("bar")))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := sender.Do(req)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if resp.ContentLength != -1 {
+		t.Fatalf("expected unknown content length, got: %d", resp.ContentLength)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	resp.Body.Close()
+	// closing the body again does not report the bytes twice
+	resp.Body.Close()
+
+	if len(reporter.requests) != 1 || reporter.requests[0].SentBytes != 3 {
+		t.Fatalf("expected 1 request with 3 bytes sent, got: %+v", reporter.requests)
+	}
+	if expected := []int64{15}; !reflect.DeepEqual(reporter.receivedBytes, expected) {
+		t.Fatalf("expected received bytes: %v, got: %v", expected, reporter.receivedBytes)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/consts"
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"monis.app/mlog"
+)
+
+// Config is the configuration for the proxy.
+type Config struct {
+	// AADUpstream is the base URL that AzureActiveDirectory requests are forwarded to.
+	AADUpstream string
+	// KeyVaultUpstream overrides the base URL that KeyVault requests are forwarded to.
+	// By default, requests are forwarded to https://<vault host> taken from the first path segment.
+	KeyVaultUpstream string
+	// AllowedVaultHosts is the list of vault hosts requests can be forwarded to.
+	// An entry starting with "*." matches any subdomain, e.g. *.vault.azure.net.
+	AllowedVaultHosts []string
+	// Transport is used to send requests upstream. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+// Proxy forwards requests from the KMS plugin in proxy mode.
+// Requests are routed by the x-azure-proxy-target header. KeyVault requests carry the vault
+// host as the first path segment, e.g. /myvault.vault.azure.net/keys/key1/version/encrypt.
+type Proxy struct {
+	aadUpstream       *url.URL
+	keyVaultUpstream  *url.URL
+	allowedVaultHosts []string
+	reverseProxy      *httputil.ReverseProxy
+	reporter          metrics.ProxyStatsReporter
+}
+
+type upstreamKey struct{}
+
+// New returns a new proxy.
+func New(config Config) (*Proxy, error) {
+	if config.AADUpstream == "" {
+		return nil, fmt.Errorf("aad upstream is required")
+	}
+	aadUpstream, err := parseUpstream(config.AADUpstream)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyVaultUpstream *url.URL
+	if config.KeyVaultUpstream != "" {
+		if keyVaultUpstream, err = parseUpstream(config.KeyVaultUpstream); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.AllowedVaultHosts) == 0 {
+		return nil, fmt.Errorf("at least one allowed vault host is required")
+	}
+	allowedVaultHosts := make([]string, 0, len(config.AllowedVaultHosts))
+	for _, host := range config.AllowedVaultHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if err := validateAllowedVaultHost(host); err != nil {
+			return nil, err
+		}
+		allowedVaultHosts = append(allowedVaultHosts, host)
+	}
+
+	reporter, err := metrics.NewProxyStatsReporter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stats reporter: %w", err)
+	}
+
+	transport := config.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Proxy{
+		aadUpstream:       aadUpstream,
+		keyVaultUpstream:  keyVaultUpstream,
+		allowedVaultHosts: allowedVaultHosts,
+		reporter:          reporter,
+		reverseProxy: &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.Out.URL = pr.In.Context().Value(upstreamKey{}).(*url.URL)
+				pr.Out.Host = ""
+				pr.Out.Header.Del(consts.RequestHeaderTargetType)
+			},
+			Transport: transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				mlog.Error("failed to forward request", err, "target", r.Header.Get(consts.RequestHeaderTargetType))
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+	}, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	target := r.Header.Get(consts.RequestHeaderTargetType)
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+
+	upstream, host, statusCode, err := p.route(target, r.URL)
+	defer func() {
+		duration := time.Since(start)
+		metricTarget := target
+		if statusCode == http.StatusBadRequest {
+			// the header value is not reported to keep the metric cardinality bounded
+			metricTarget = "invalid"
+		}
+		p.reporter.ReportProxyRequest(r.Context(), metricTarget, host, recorder.statusCode, duration.Seconds())
+		mlog.Info("proxied request",
+			"target", target,
+			"method", r.Method,
+			"host", host,
+			"path", r.URL.Path,
+			"statusCode", recorder.statusCode,
+			"duration", duration.String(),
+		)
+	}()
+
+	if err != nil {
+		mlog.Error("rejected request", err, "target", target, "path", r.URL.Path)
+		http.Error(recorder, err.Error(), statusCode)
+		return
+	}
+
+	p.reverseProxy.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, upstream)))
+}
+
+// route returns the upstream URL for the request based on the target type, and the
+// destination host reported in logs and metrics.
+func (p *Proxy) route(target string, requestURL *url.URL) (*url.URL, string, int, error) {
+	switch target {
+	case consts.TargetTypeAzureActiveDirectory:
+		return joinURL(p.aadUpstream, requestURL.Path, requestURL.RawQuery), p.aadUpstream.Host, http.StatusOK, nil
+	case consts.TargetTypeKeyVault:
+		vaultHost, path, _ := strings.Cut(strings.TrimLeft(requestURL.Path, "/"), "/")
+		vaultHost = strings.ToLower(vaultHost)
+		if !p.isAllowedVaultHost(vaultHost) {
+			// the host is not reported to keep the metric cardinality bounded
+			return nil, "", http.StatusForbidden, fmt.Errorf("vault host %q is not allowed", vaultHost)
+		}
+		base := p.keyVaultUpstream
+		if base == nil {
+			base = &url.URL{Scheme: "https", Host: vaultHost}
+		}
+		return joinURL(base, path, requestURL.RawQuery), vaultHost, http.StatusOK, nil
+	default:
+		return nil, "", http.StatusBadRequest, fmt.Errorf("invalid %s header value %q", consts.RequestHeaderTargetType, target)
+	}
+}
+
+func (p *Proxy) isAllowedVaultHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, allowed := range p.allowedVaultHosts {
+		// the suffix keeps the dot, so *.vault.azure.net does not match evilvault.azure.net
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAllowedVaultHost rejects empty entries and wildcards other than a leading "*.".
+func validateAllowedVaultHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return fmt.Errorf("invalid allowed vault host %q, only a leading *. wildcard is supported", host)
+	}
+	return nil
+}
+
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream %s, error: %w", upstream, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %s, scheme and host are required", upstream)
+	}
+	return u, nil
+}
+
+func joinURL(base *url.URL, path, rawQuery string) *url.URL {
+	joined := *base
+	joined.Path = strings.TrimRight(base.Path, "/") + "/" + strings.TrimLeft(path, "/")
+	joined.RawPath = ""
+	joined.RawQuery = rawQuery
+	return &joined
+}
+
+// statusRecorder records the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
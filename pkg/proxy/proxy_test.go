@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/kubernetes-kms/pkg/consts"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config Config
+	}{
+		{
+			desc:   "missing aad upstream",
+			config: Config{AllowedVaultHosts: []string{"*.vault.azure.net"}},
+		},
+		{
+			desc:   "invalid aad upstream",
+			config: Config{AADUpstream: "login.microsoftonline.com", AllowedVaultHosts: []string{"*.vault.azure.net"}},
+		},
+		{
+			desc:   "invalid keyvault upstream",
+			config: Config{AADUpstream: "https://login.microsoftonline.com/", KeyVaultUpstream: "://", AllowedVaultHosts: []string{"*.vault.azure.net"}},
+		},
+		{
+			desc:   "missing allowed vault hosts",
+			config: Config{AADUpstream: "https://login.microsoftonline.com/"},
+		},
+		{
+			desc:   "wildcard without dot",
+			config: Config{AADUpstream: "https://login.microsoftonline.com/", AllowedVaultHosts: []string{"*vault.azure.net"}},
+		},
+		{
+			desc:   "wildcard in the middle",
+			config: Config{AADUpstream: "https://login.microsoftonline.com/", AllowedVaultHosts: []string{"testkv.*.azure.net"}},
+		},
+		{
+			desc:   "empty allowed vault host",
+			config: Config{AADUpstream: "https://login.microsoftonline.com/", AllowedVaultHosts: []string{"*.vault.azure.net", " "}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if _, err := New(test.config); err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestProxy(t *testing.T) {
+	type upstreamRequest struct {
+		path   string
+		query  string
+		target string
+		body   string
+	}
+	var aadRequest, kvRequest *upstreamRequest
+	newUpstream := func(received **upstreamRequest, response string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			*received = &upstreamRequest{
+				path:   r.URL.Path,
+				query:  r.URL.RawQuery,
+				target: r.Header.Get(consts.RequestHeaderTargetType),
+				body:   string(body),
+			}
+			_, _ = w.Write([]byte(response))
+		}))
+	}
+	aadServer := newUpstream(&aadRequest, "token")
+	defer aadServer.Close()
+	kvServer := newUpstream(&kvRequest, "ciphertext")
+	defer kvServer.Close()
+
+	p, err := New(Config{
+		AADUpstream:       aadServer.URL + "/",
+		KeyVaultUpstream:  kvServer.URL,
+		AllowedVaultHosts: []string{"*.vault.azure.net", "testkv.managedhsm.azure.net"},
+	})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	tests := []struct {
+		desc               string
+		target             string
+		path               string
+		expectedStatusCode int
+		expectedAAD        *upstreamRequest
+		expectedKV         *upstreamRequest
+		expectedBody       string
+	}{
+		{
+			desc:               "forward to aad",
+			target:             consts.TargetTypeAzureActiveDirectory,
+			path:               "/tenant/oauth2/token?api-version=1.0",
+			expectedStatusCode: http.StatusOK,
+			expectedAAD:        &upstreamRequest{path: "/tenant/oauth2/token", query: "api-version=1.0", body: "payload"},
+			expectedBody:       "token",
+		},
+		{
+			desc:               "forward to keyvault matching wildcard",
+			target:             consts.TargetTypeKeyVault,
+			path:               "/testkv.vault.azure.net/keys/key1/version1/encrypt?api-version=7.0",
+			expectedStatusCode: http.StatusOK,
+			expectedKV:         &upstreamRequest{path: "/keys/key1/version1/encrypt", query: "api-version=7.0", body: "payload"},
+			expectedBody:       "ciphertext",
+		},
+		{
+			desc:               "forward to keyvault matching exact host",
+			target:             consts.TargetTypeKeyVault,
+			path:               "/TestKV.managedhsm.azure.net/keys/key1",
+			expectedStatusCode: http.StatusOK,
+			expectedKV:         &upstreamRequest{path: "/keys/key1", body: "payload"},
+			expectedBody:       "ciphertext",
+		},
+		{
+			desc:               "vault host not allowed",
+			target:             consts.TargetTypeKeyVault,
+			path:               "/testkv.vault.example.com/keys/key1",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			desc:               "wildcard does not match the bare suffix",
+			target:             consts.TargetTypeKeyVault,
+			path:               "/vault.azure.net/keys/key1",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			desc:               "wildcard does not match a host sharing the suffix",
+			target:             consts.TargetTypeKeyVault,
+			path:               "/evilvault.azure.net/keys/key1",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			desc:               "missing target header",
+			path:               "/tenant/oauth2/token",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			desc:               "invalid target header",
+			target:             "Storage",
+			path:               "/tenant/oauth2/token",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			aadRequest, kvRequest = nil, nil
+
+			req, err := http.NewRequest(http.MethodPost, proxyServer.URL+test.path, strings.NewReader("payload"))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if test.target != "" {
+				req.Header.Set(consts.RequestHeaderTargetType, test.target)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatusCode {
+				t.Fatalf("expected status code: %d, got: %d", test.expectedStatusCode, resp.StatusCode)
+			}
+			if test.expectedBody != "" && string(body) != test.expectedBody {
+				t.Fatalf("expected body: %q, got: %q", test.expectedBody, string(body))
+			}
+			if !equalRequest(aadRequest, test.expectedAAD) {
+				t.Fatalf("expected aad request: %+v, got: %+v", test.expectedAAD, aadRequest)
+			}
+			if !equalRequest(kvRequest, test.expectedKV) {
+				t.Fatalf("expected keyvault request: %+v, got: %+v", test.expectedKV, kvRequest)
+			}
+		})
+	}
+}
+
+func TestProxyUpstreamUnavailable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstreamURL := upstream.URL
+	upstream.Close()
+
+	p, err := New(Config{
+		AADUpstream:       upstreamURL,
+		AllowedVaultHosts: []string{"*.vault.azure.net"},
+	})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/tenant/oauth2/token", nil)
+	req.Header.Set(consts.RequestHeaderTargetType, consts.TargetTypeAzureActiveDirectory)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected status code: %d, got: %d", http.StatusBadGateway, rec.Code)
+	}
+}
+
+func equalRequest[T comparable](actual, expected *T) bool {
+	if actual == nil || expected == nil {
+		return actual == expected
+	}
+	return *actual == *expected
+}
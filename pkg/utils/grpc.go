@@ -3,53 +3,183 @@ package utils
 import (
 	"context"
 	"fmt"
+	"net"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/kubernetes-kms/pkg/metrics"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 	"monis.app/mlog"
 )
 
-// ParseEndpoint returns unix socket's protocol and address.
+// GRPCServerLimits configures the message sizes, keepalive enforcement and connection limits of the gRPC server.
+type GRPCServerLimits struct {
+	// MaxRecvMsgSize and MaxSendMsgSize are the maximum message sizes in bytes.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// MaxConcurrentStreams is the maximum number of concurrent streams per connection. 0 means no limit.
+	MaxConcurrentStreams uint32
+	// KeepaliveMinTime is the minimum time clients must wait between keepalive pings. Connections of clients
+	// that ping more often, or ping without active streams unless KeepalivePermitWithoutStream is set, are closed.
+	KeepaliveMinTime             time.Duration
+	KeepalivePermitWithoutStream bool
+	// ConnectionTimeout bounds the connection setup, including the TLS handshake.
+	ConnectionTimeout time.Duration
+}
+
+// ServerOptions returns the gRPC server options that enforce the limits.
+func (l GRPCServerLimits) ServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(l.MaxRecvMsgSize),
+		grpc.MaxSendMsgSize(l.MaxSendMsgSize),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             l.KeepaliveMinTime,
+			PermitWithoutStream: l.KeepalivePermitWithoutStream,
+		}),
+		grpc.ConnectionTimeout(l.ConnectionTimeout),
+	}
+	if l.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(l.MaxConcurrentStreams))
+	}
+	return opts
+}
+
+// ParseEndpoint returns the protocol and address of a unix://<path> or tcp://<host>:<port> endpoint.
+// For systemd://[<name>], the address is the name of the socket passed by systemd socket activation.
 func ParseEndpoint(ep string) (string, string, error) {
 	if strings.HasPrefix(strings.ToLower(ep), "unix://") {
 		s := strings.SplitN(ep, "://", 2)
 		if s[1] != "" {
-			return s[0], s[1], nil
+			return "unix", s[1], nil
 		}
 	}
+	if strings.HasPrefix(strings.ToLower(ep), "tcp://") {
+		s := strings.SplitN(ep, "://", 2)
+		if _, port, err := net.SplitHostPort(s[1]); err == nil && port != "" {
+			return "tcp", s[1], nil
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(ep), "systemd://") {
+		s := strings.SplitN(ep, "://", 2)
+		return "systemd", s[1], nil
+	}
 	return "", "", fmt.Errorf("invalid endpoint: %v", ep)
 }
 
+var (
+	statsReporterOnce sync.Once
+	statsReporter     metrics.StatsReporter
+	statsReporterErr  error
+)
+
+// getStatsReporter returns the stats reporter shared by all calls of the interceptors,
+// so the instrument is created once instead of per RPC.
+func getStatsReporter() (metrics.StatsReporter, error) {
+	statsReporterOnce.Do(func() {
+		statsReporter, statsReporterErr = metrics.NewStatsReporter()
+	})
+	return statsReporter, statsReporterErr
+}
+
 // UnaryServerInterceptor provides metrics around Unary RPCs.
 func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	var err error
 	start := time.Now()
-	reporter, err := metrics.NewStatsReporter()
+	reporter, err := getStatsReporter()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create stats reporter: %w", err)
 	}
 
 	defer func() {
-		errors := ""
-		status := metrics.SuccessStatusTypeValue
-		if err != nil {
-			status = metrics.ErrorStatusTypeValue
-			errors = err.Error()
-		}
-		reporter.ReportRequest(ctx, fmt.Sprintf("%s_%s", metrics.GrpcOperationTypeValue, getGRPCMethodName(info.FullMethod)), status, time.Since(start).Seconds(), errors)
+		reporter.ReportRequest(ctx, fmt.Sprintf("%s_%s", metrics.GrpcOperationTypeValue, getGRPCMethodName(info.FullMethod)), time.Since(start).Seconds(), err)
 	}()
 
-	mlog.Trace("GRPC call", "method", info.FullMethod)
+	mlog.Trace("GRPC call", "method", info.FullMethod, "origin", metrics.Origin(ctx))
 	resp, err := handler(ctx, req)
 	if err != nil {
-		mlog.Error("GRPC request error", err)
+		mlog.Error("GRPC request error", err, "method", info.FullMethod, "origin", metrics.Origin(ctx))
 	}
 	return resp, err
 }
 
+// StreamServerInterceptor provides metrics around streaming RPCs, e.g. health watches and server reflection.
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	var err error
+	start := time.Now()
+	reporter, err := getStatsReporter()
+	if err != nil {
+		return fmt.Errorf("failed to create stats reporter: %w", err)
+	}
+
+	defer func() {
+		reporter.ReportRequest(ss.Context(), fmt.Sprintf("%s_%s", metrics.GrpcOperationTypeValue, getGRPCMethodName(info.FullMethod)), time.Since(start).Seconds(), err)
+	}()
+
+	mlog.Trace("GRPC stream", "method", info.FullMethod)
+	err = handler(srv, ss)
+	if err != nil {
+		mlog.Error("GRPC stream error", err)
+	}
+	return err
+}
+
+// RecoveryUnaryInterceptor turns a panic in the handler into an Internal error,
+// so a bad request cannot crash the plugin that kube-apiserver depends on.
+func RecoveryUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverPanic(info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// RecoveryStreamInterceptor turns a panic in the stream handler into an Internal error.
+func RecoveryStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverPanic(info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+func recoverPanic(method string, r interface{}) error {
+	mlog.Error("recovered from panic in GRPC handler", fmt.Errorf("%v", r), "method", method, "stack", string(debug.Stack()))
+	return status.Errorf(codes.Internal, "internal error in %s", method)
+}
+
+// ProviderUnaryInterceptor returns an interceptor that tags the metrics of each call with the provider.
+// It must run before the other interceptors when one process hosts multiple KMS providers.
+func ProviderUnaryInterceptor(provider string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(metrics.WithProvider(ctx, provider), req)
+	}
+}
+
+// ProviderStreamInterceptor returns an interceptor that tags the metrics of each stream with the provider.
+func ProviderStreamInterceptor(provider string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: metrics.WithProvider(ss.Context(), provider)})
+	}
+}
+
+// contextServerStream overrides the context of a grpc.ServerStream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
 func getGRPCMethodName(fullMethodName string) string {
 	fullMethodName = strings.TrimPrefix(fullMethodName, "/")
 	methodNames := strings.Split(fullMethodName, "/")
@@ -1,6 +1,20 @@
 package utils
 
-import "testing"
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
 
 func TestParseEndpoint(t *testing.T) {
 	tests := []struct {
@@ -29,6 +43,32 @@ func TestParseEndpoint(t *testing.T) {
 			expectedAddr:  "/provider/azure.sock",
 			expectedErr:   false,
 		},
+		{
+			desc:          "valid tcp endpoint",
+			endpoint:      "tcp://0.0.0.0:6443",
+			expectedProto: "tcp",
+			expectedAddr:  "0.0.0.0:6443",
+			expectedErr:   false,
+		},
+		{
+			desc:        "tcp endpoint without port",
+			endpoint:    "tcp://kms.local",
+			expectedErr: true,
+		},
+		{
+			desc:          "systemd endpoint",
+			endpoint:      "systemd://",
+			expectedProto: "systemd",
+			expectedAddr:  "",
+			expectedErr:   false,
+		},
+		{
+			desc:          "named systemd endpoint",
+			endpoint:      "systemd://kms",
+			expectedProto: "systemd",
+			expectedAddr:  "kms",
+			expectedErr:   false,
+		},
 	}
 
 	for _, test := range tests {
@@ -75,3 +115,73 @@ func TestGetGRPCMethodName(t *testing.T) {
 		})
 	}
 }
+
+func TestRecoveryInterceptors(t *testing.T) {
+	_, err := RecoveryUnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/v2.KeyManagementService/Encrypt"},
+		func(context.Context, interface{}) (interface{}, error) {
+			panic("unexpected")
+		})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expected code %v, got: %v", codes.Internal, err)
+	}
+
+	err = RecoveryStreamInterceptor(nil, &fakeServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/grpc.health.v1.Health/Watch"},
+		func(interface{}, grpc.ServerStream) error {
+			panic("unexpected")
+		})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expected code %v, got: %v", codes.Internal, err)
+	}
+}
+
+func TestGRPCServerLimitsMaxRecvMsgSize(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "kms.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	limits := GRPCServerLimits{
+		MaxRecvMsgSize:    64,
+		MaxSendMsgSize:    64,
+		KeepaliveMinTime:  time.Minute,
+		ConnectionTimeout: time.Second,
+	}
+	s := grpc.NewServer(limits.ServerOptions()...)
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(listener)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("unix://"+listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	tests := []struct {
+		desc         string
+		service      string
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "message within limit",
+			service:      "",
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "message over limit",
+			service:      strings.Repeat("a", 128),
+			expectedCode: codes.ResourceExhausted,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: test.service})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("expected code %v, got: %v", test.expectedCode, err)
+			}
+		})
+	}
+}
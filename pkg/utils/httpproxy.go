@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPProxyConfig is the configuration of a standard forward proxy used to reach Key Vault and AAD.
+// Unset values fall back to the HTTPS_PROXY and NO_PROXY environment variables.
+// This is independent of proxy mode, which rewrites the request URLs and sets the target header.
+type HTTPProxyConfig struct {
+	// HTTPSProxy is the URL of the proxy. Basic auth credentials may be set in the userinfo.
+	HTTPSProxy string
+	// NoProxy is a comma separated list of hosts, domains and CIDRs that bypass the proxy.
+	NoProxy string
+	// CredentialsFile is a file with the proxy basic auth credentials in the form username:password.
+	// It takes precedence over the credentials in HTTPSProxy.
+	CredentialsFile string
+}
+
+// ProxyFunc returns the proxy function to use in the http transport.
+func (c *HTTPProxyConfig) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	cfg := httpproxy.FromEnvironment()
+	if c.HTTPSProxy != "" {
+		cfg.HTTPSProxy = c.HTTPSProxy
+	}
+	if c.NoProxy != "" {
+		cfg.NoProxy = c.NoProxy
+	}
+
+	if c.CredentialsFile != "" {
+		if cfg.HTTPSProxy == "" {
+			return nil, fmt.Errorf("proxy credentials file %s is set without a proxy", c.CredentialsFile)
+		}
+		proxyURL, err := parseProxyURL(cfg.HTTPSProxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy url, error: %w", err)
+		}
+		user, err := readProxyCredentials(c.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		proxyURL.User = user
+		cfg.HTTPSProxy = proxyURL.String()
+	}
+
+	proxyFunc := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}, nil
+}
+
+// parseProxyURL parses proxy like httpproxy.Config does, so the credentials are also set
+// on a proxy without scheme, e.g. proxy:3128, which is then an http proxy.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+		if proxyURL, err := url.Parse("http://" + proxy); err == nil {
+			return proxyURL, nil
+		}
+	}
+	return proxyURL, err
+}
+
+// readProxyCredentials reads the username:password proxy credentials from file.
+func readProxyCredentials(credentialsFile string) (*url.Userinfo, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy credentials file %s, error: %w", credentialsFile, err)
+	}
+	username, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok || username == "" {
+		return nil, fmt.Errorf("invalid proxy credentials in file %s, expected username:password", credentialsFile)
+	}
+	return url.UserPassword(username, password), nil
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"monis.app/mlog"
+)
+
+const peerCredentialsAuthType = "peercred"
+
+// PeerAllowlist is the list of local processes allowed to call the plugin on the unix socket.
+// A process is allowed if its uid, gid or executable path is in the list.
+type PeerAllowlist struct {
+	UIDs []uint32
+	GIDs []uint32
+	// Executables are absolute paths, compared with /proc/<pid>/exe of the peer.
+	Executables []string
+}
+
+// IsEmpty returns true if no process is allowed by the list.
+func (a PeerAllowlist) IsEmpty() bool {
+	return len(a.UIDs) == 0 && len(a.GIDs) == 0 && len(a.Executables) == 0
+}
+
+// PeerAuthInfo is the grpc AuthInfo for a connection on the unix socket.
+type PeerAuthInfo struct {
+	credentials.CommonAuthInfo
+	UID        uint32
+	GID        uint32
+	PID        int32
+	Executable string
+	Allowed    bool
+}
+
+// AuthType returns the type of the auth info.
+func (PeerAuthInfo) AuthType() string {
+	return peerCredentialsAuthType
+}
+
+// peerCredentials are grpc transport credentials that read SO_PEERCRED for each connection on
+// the unix socket and authorize the peer against the allowlist. The decision is enforced
+// by PeerAuthorizationUnaryInterceptor, so denied calls fail with PermissionDenied.
+type peerCredentials struct {
+	allowlist PeerAllowlist
+	provider  string
+	reporter  metrics.PeerStatsReporter
+}
+
+// NewPeerCredentials returns grpc server transport credentials that authorize unix socket peers.
+// The provider tags the reported metrics when one process hosts multiple KMS providers.
+func NewPeerCredentials(allowlist PeerAllowlist, provider string) (credentials.TransportCredentials, error) {
+	reporter, err := metrics.NewPeerStatsReporter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stats reporter: %w", err)
+	}
+	return &peerCredentials{allowlist: allowlist, provider: provider, reporter: reporter}, nil
+}
+
+func (c *peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("peer credentials require a unix socket, got: %s", conn.RemoteAddr().Network())
+	}
+	cred, err := getPeerCredentials(unixConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := PeerAuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		UID:            cred.Uid,
+		GID:            cred.Gid,
+		PID:            cred.Pid,
+	}
+	// the executable is only readable for peers in the same pid namespace, and requires
+	// the same uid or CAP_SYS_PTRACE. The peer is not matched by executable if it cannot be read.
+	if exe, err := os.Readlink("/proc/" + strconv.Itoa(int(cred.Pid)) + "/exe"); err == nil {
+		info.Executable = exe
+	}
+	// the health check connects from the plugin process itself
+	info.Allowed = int(cred.Pid) == os.Getpid() || c.allowlist.allows(info)
+
+	decision := metrics.AllowedDecisionValue
+	if info.Allowed {
+		mlog.Info("allowed connection from peer", "uid", info.UID, "gid", info.GID, "pid", info.PID, "executable", info.Executable)
+	} else {
+		decision = metrics.DeniedDecisionValue
+		mlog.Warning("denied connection from peer", "uid", info.UID, "gid", info.GID, "pid", info.PID, "executable", info.Executable)
+	}
+	c.reporter.ReportPeerAuthorization(metrics.WithProvider(context.Background(), c.provider), info.UID, decision)
+
+	return conn, info, nil
+}
+
+func (c *peerCredentials) ClientHandshake(_ context.Context, _ string, _ net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, fmt.Errorf("peer credentials are only supported by the server")
+}
+
+func (c *peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: peerCredentialsAuthType}
+}
+
+func (c *peerCredentials) Clone() credentials.TransportCredentials {
+	return &peerCredentials{allowlist: c.allowlist, provider: c.provider, reporter: c.reporter}
+}
+
+func (c *peerCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+func (a PeerAllowlist) allows(info PeerAuthInfo) bool {
+	return slices.Contains(a.UIDs, info.UID) ||
+		slices.Contains(a.GIDs, info.GID) ||
+		(info.Executable != "" && slices.Contains(a.Executables, info.Executable))
+}
+
+// PeerAuthorizationUnaryInterceptor rejects calls from unix socket peers that are not allowed
+// by the peer credentials with PermissionDenied.
+func PeerAuthorizationUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if authInfo, ok := p.AuthInfo.(PeerAuthInfo); ok && !authInfo.Allowed {
+			return nil, status.Errorf(codes.PermissionDenied, "peer uid %d, gid %d is not allowed to call %s", authInfo.UID, authInfo.GID, info.FullMethod)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// PeerAuthorizationStreamInterceptor rejects streams, e.g. health watches and server reflection,
+// from unix socket peers that are not allowed by the peer credentials with PermissionDenied.
+func PeerAuthorizationStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p, ok := peer.FromContext(ss.Context()); ok {
+		if authInfo, ok := p.AuthInfo.(PeerAuthInfo); ok && !authInfo.Allowed {
+			return status.Errorf(codes.PermissionDenied, "peer uid %d, gid %d is not allowed to call %s", authInfo.UID, authInfo.GID, info.FullMethod)
+		}
+	}
+	return handler(srv, ss)
+}
+
+func getPeerCredentials(conn *net.UnixConn) (*syscall.Ucred, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw connection, error: %w", err)
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to access connection, error: %w", err)
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to get peer credentials, error: %w", credErr)
+	}
+	return cred, nil
+}
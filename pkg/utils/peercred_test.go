@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestPeerAllowlistAllows(t *testing.T) {
+	allowlist := PeerAllowlist{
+		UIDs:        []uint32{0},
+		GIDs:        []uint32{1000},
+		Executables: []string{"/usr/local/bin/kube-apiserver"},
+	}
+
+	tests := []struct {
+		desc     string
+		info     PeerAuthInfo
+		expected bool
+	}{
+		{
+			desc:     "allowed uid",
+			info:     PeerAuthInfo{UID: 0, GID: 0},
+			expected: true,
+		},
+		{
+			desc:     "allowed gid",
+			info:     PeerAuthInfo{UID: 1000, GID: 1000},
+			expected: true,
+		},
+		{
+			desc:     "allowed executable",
+			info:     PeerAuthInfo{UID: 1001, GID: 1001, Executable: "/usr/local/bin/kube-apiserver"},
+			expected: true,
+		},
+		{
+			desc: "not allowed",
+			info: PeerAuthInfo{UID: 1001, GID: 1001, Executable: "/usr/bin/curl"},
+		},
+		{
+			desc: "unknown executable",
+			info: PeerAuthInfo{UID: 1001, GID: 1001},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if actual := allowlist.allows(test.info); actual != test.expected {
+				t.Fatalf("expected: %v, got: %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPeerCredentialsServerHandshake(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "kms.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer server.Close()
+
+	creds, err := NewPeerCredentials(PeerAllowlist{UIDs: []uint32{12345}}, "")
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	_, authInfo, err := creds.ServerHandshake(server)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	info, ok := authInfo.(PeerAuthInfo)
+	if !ok {
+		t.Fatalf("expected PeerAuthInfo, got: %T", authInfo)
+	}
+	if int(info.UID) != os.Getuid() || int(info.PID) != os.Getpid() {
+		t.Fatalf("expected uid: %d and pid: %d, got uid: %d and pid: %d", os.Getuid(), os.Getpid(), info.UID, info.PID)
+	}
+	// the plugin process is always allowed, so the health check can connect
+	if !info.Allowed {
+		t.Fatalf("expected connection from the same process to be allowed")
+	}
+}
+
+func TestPeerAuthorizationUnaryInterceptor(t *testing.T) {
+	tests := []struct {
+		desc         string
+		authInfo     *PeerAuthInfo
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "no peer credentials",
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "allowed peer",
+			authInfo:     &PeerAuthInfo{UID: 0, Allowed: true},
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "denied peer",
+			authInfo:     &PeerAuthInfo{UID: 1001},
+			expectedCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx := context.Background()
+			if test.authInfo != nil {
+				ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: *test.authInfo})
+			}
+			handler := func(context.Context, interface{}) (interface{}, error) {
+				return "ok", nil
+			}
+			_, err := PeerAuthorizationUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/v2.KeyManagementService/Decrypt"}, handler)
+			if code := status.Code(err); code != test.expectedCode {
+				t.Fatalf("expected code: %v, got: %v", test.expectedCode, code)
+			}
+		})
+	}
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestPeerAuthorizationStreamInterceptor(t *testing.T) {
+	tests := []struct {
+		desc         string
+		authInfo     *PeerAuthInfo
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "no peer credentials",
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "allowed peer",
+			authInfo:     &PeerAuthInfo{UID: 0, Allowed: true},
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "denied peer",
+			authInfo:     &PeerAuthInfo{UID: 1001},
+			expectedCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx := context.Background()
+			if test.authInfo != nil {
+				ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: *test.authInfo})
+			}
+			handler := func(interface{}, grpc.ServerStream) error {
+				return nil
+			}
+			err := PeerAuthorizationStreamInterceptor(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/grpc.health.v1.Health/Watch"}, handler)
+			if code := status.Code(err); code != test.expectedCode {
+				t.Fatalf("expected code: %v, got: %v", test.expectedCode, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"monis.app/mlog"
+)
+
+// UnixSocketOptions configures the ownership and permissions of a unix socket.
+type UnixSocketOptions struct {
+	// Mode is the permission of the socket file. 0 keeps the permission given by the process umask.
+	Mode os.FileMode
+	// UID and GID are the owner of the socket file. -1 keeps the owner of the process.
+	UID int
+	GID int
+}
+
+// unixSocketDialTimeout is how long to wait when checking if an existing socket is in use.
+const unixSocketDialTimeout = time.Second
+
+// ListenUnix listens on the unix socket at path.
+// A path starting with "@" is a socket in the Linux abstract namespace, which has no file on disk.
+// Otherwise, an advisory lock on <path>.lock guards the socket against other instances, and an
+// existing socket is only removed if nothing is listening on it. The returned closer removes the
+// socket and releases the lock.
+func ListenUnix(path string, opts UnixSocketOptions) (net.Listener, io.Closer, error) {
+	if strings.HasPrefix(path, "@") {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to listen on abstract socket %s, error: %w", path, err)
+		}
+		return listener, io.NopCloser(nil), nil
+	}
+
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listener, err := listenUnix(path, opts)
+	if err != nil {
+		lock.Close()
+		return nil, nil, err
+	}
+	return listener, &socketLock{path: path, lock: lock}, nil
+}
+
+// socketLock removes the unix socket and then releases the lock that guards it.
+type socketLock struct {
+	path string
+	lock *os.File
+}
+
+func (l *socketLock) Close() error {
+	err := os.Remove(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("failed to remove socket file %s, error: %w", l.path, err)
+	} else {
+		err = nil
+	}
+	return errors.Join(err, l.lock.Close())
+}
+
+func listenUnix(path string, opts UnixSocketOptions) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// create the socket without any permission, so no client can connect before the
+	// ownership and mode are set. This runs during startup before other files are created.
+	oldMask := syscall.Umask(0o777)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket %s, error: %w", path, err)
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = os.FileMode(0o777 &^ oldMask)
+	}
+
+	if opts.UID != -1 || opts.GID != -1 {
+		if err := os.Chown(path, opts.UID, opts.GID); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to change owner of socket %s to %d:%d, error: %w", path, opts.UID, opts.GID, err)
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to change mode of socket %s to %s, error: %w", path, mode, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat socket %s, error: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, unixSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check if socket %s is in use, error: %w", path, err)
+	}
+
+	mlog.Always("removing stale socket", "path", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove socket file %s, error: %w", path, err)
+	}
+	return nil
+}
+
+// lockFile takes an exclusive advisory lock on path, and fails if another process holds it.
+// The lock is released when the returned file is closed or the process exits.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s, error: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("lock file %s is held by another instance", path)
+		}
+		return nil, fmt.Errorf("failed to lock %s, error: %w", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	opts := UnixSocketOptions{Mode: 0o660, UID: os.Getuid(), GID: os.Getgid()}
+
+	socketPath := filepath.Join(dir, "kms.sock")
+	listener, lock, err := ListenUnix(socketPath, opts)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	defer lock.Close()
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Fatalf("expected socket mode: %v, got: %v", os.FileMode(0o660), info.Mode().Perm())
+	}
+
+	// a second instance fails to take the lock and leaves the socket in place
+	if _, _, err := ListenUnix(socketPath, opts); err == nil {
+		t.Fatalf("expected error for locked socket, got nil")
+	}
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Fatalf("expected socket to still exist, got: %v", err)
+	}
+}
+
+func TestListenUnixUmask(t *testing.T) {
+	oldMask := syscall.Umask(0o027)
+	defer syscall.Umask(oldMask)
+
+	socketPath := filepath.Join(t.TempDir(), "kms.sock")
+	listener, lock, err := ListenUnix(socketPath, UnixSocketOptions{UID: -1, GID: -1})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	defer lock.Close()
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0o750 {
+		t.Fatalf("expected socket mode: %v, got: %v", os.FileMode(0o750), info.Mode().Perm())
+	}
+}
+
+func TestListenUnixExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	opts := UnixSocketOptions{Mode: 0o600, UID: -1, GID: -1}
+
+	t.Run("stale socket is replaced", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "stale.sock")
+		stale, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, lock, err := ListenUnix(socketPath, opts)
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+		listener.Close()
+		lock.Close()
+	})
+
+	t.Run("socket in use", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "inuse.sock")
+		inUse, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer inUse.Close()
+
+		if _, _, err := ListenUnix(socketPath, opts); err == nil {
+			t.Fatalf("expected error for socket in use, got nil")
+		}
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "file.sock")
+		if err := os.WriteFile(socketPath, []byte("data"), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		if _, _, err := ListenUnix(socketPath, opts); err == nil {
+			t.Fatalf("expected error for regular file, got nil")
+		}
+		if _, err := os.Stat(socketPath); err != nil {
+			t.Fatalf("expected file to not be removed, got: %v", err)
+		}
+	})
+}
+
+func TestListenUnixAbstract(t *testing.T) {
+	socketPath := fmt.Sprintf("@kms-test-%d", time.Now().UnixNano())
+	listener, lock, err := ListenUnix(socketPath, UnixSocketOptions{UID: -1, GID: -1})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	defer lock.Close()
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to connect to abstract socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenUnixCloseRemovesSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "kms.sock")
+	listener, lock, err := ListenUnix(socketPath, UnixSocketOptions{Mode: 0o600, UID: -1, GID: -1})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	if err := lock.Close(); err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be removed, got: %v", err)
+	}
+	// the lock is released, so another instance can listen on the socket
+	listener, lock, err = ListenUnix(socketPath, UnixSocketOptions{Mode: 0o600, UID: -1, GID: -1})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	listener.Close()
+	lock.Close()
+}
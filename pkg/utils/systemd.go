@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// systemdFirstFD is the first file descriptor passed by systemd socket activation.
+	systemdFirstFD = 3
+
+	// SdNotifyReady tells systemd the service finished starting up.
+	SdNotifyReady = "READY=1"
+	// SdNotifyStopping tells systemd the service is shutting down.
+	SdNotifyStopping = "STOPPING=1"
+)
+
+// SystemdListener is a listener passed by systemd socket activation.
+type SystemdListener struct {
+	// Name is the FileDescriptorName= of the socket unit, or the socket unit name by default.
+	Name     string
+	Listener net.Listener
+}
+
+// SystemdListeners returns the listeners passed by systemd socket activation through
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES. It returns nil if the process was not socket activated.
+// The environment variables are unset, so they are not inherited by child processes.
+func SystemdListeners() ([]SystemdListener, error) {
+	return systemdListeners(systemdFirstFD)
+}
+
+func systemdListeners(firstFD int) ([]SystemdListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]SystemdListener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// FileListener duplicates the file descriptor, and the listener does not unlink
+		// the socket file on close, so it survives restarts of the plugin.
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create listener from file descriptor %d, error: %w", fd, err)
+		}
+		listeners = append(listeners, SystemdListener{Name: name, Listener: listener})
+	}
+	return listeners, nil
+}
+
+// SdNotify sends state to the systemd notification socket in NOTIFY_SOCKET.
+// It returns false if the process is not running under systemd with Type=notify.
+func SdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket, error: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to send %q to notify socket, error: %w", state, err)
+	}
+	return true, nil
+}
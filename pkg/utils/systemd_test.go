@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	t.Run("not socket activated", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "1")
+		t.Setenv("LISTEN_FDS", "1")
+
+		listeners, err := SystemdListeners()
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+		if listeners != nil {
+			t.Fatalf("expected no listeners, got: %v", listeners)
+		}
+	})
+
+	t.Run("socket activated", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "kms.sock")
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer listener.Close()
+		f, err := listener.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatalf("failed to get listener file: %v", err)
+		}
+		defer f.Close()
+
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", "1")
+		t.Setenv("LISTEN_FDNAMES", "kms")
+
+		listeners, err := systemdListeners(int(f.Fd()))
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+		if len(listeners) != 1 || listeners[0].Name != "kms" {
+			t.Fatalf("expected 1 listener named kms, got: %v", listeners)
+		}
+		if listeners[0].Listener.Addr().String() != socketPath {
+			t.Fatalf("expected listener addr: %s, got: %s", socketPath, listeners[0].Listener.Addr().String())
+		}
+		if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+			t.Fatalf("expected LISTEN_FDS to be unset")
+		}
+
+		// closing the activated listener does not remove the socket file
+		listeners[0].Listener.Close()
+		if _, err := os.Stat(socketPath); err != nil {
+			t.Fatalf("expected socket to still exist, got: %v", err)
+		}
+	})
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := SdNotify(SdNotifyReady); sent || err != nil {
+		t.Fatalf("expected notification to be skipped, got sent: %v, err: %v", sent, err)
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+
+	sent, err := SdNotify(SdNotifyReady)
+	if err != nil || !sent {
+		t.Fatalf("expected notification to be sent, got sent: %v, err: %v", sent, err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notification: %v", err)
+	}
+	if string(buf[:n]) != SdNotifyReady {
+		t.Fatalf("expected notification: %s, got: %s", SdNotifyReady, string(buf[:n]))
+	}
+}
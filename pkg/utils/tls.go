@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"monis.app/mlog"
+)
+
+// NewClientTLSConfig returns a TLS config for connecting to a server.
+// The server certificate is verified against the CA bundle in caFile, or the system roots if caFile is empty,
+// and must be valid for serverName. If certFile and keyFile are set, the client certificate is presented for mTLS.
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both client certificate and key are required for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s and key %s, error: %w", certFile, keyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewServerTLSConfig returns a TLS config for serving with the certificate in certFile and keyFile.
+// If clientCAFile is set, clients must present a certificate signed by one of its CAs.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate %s and key %s, error: %w", certFile, keyFile, err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool returns a cert pool with the PEM encoded certificates in caFile.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s, error: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no valid certificates found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
+
+// NewReloadingServerTLSConfig returns a TLS config for serving with mandatory client certificates.
+// The server certificate and client CA bundle are reloaded when the files change on disk, so rotated
+// certificates are picked up by new connections without a restart. If allowedClientSubjects is not empty,
+// the client certificate common name or one of its DNS names must be in the list.
+func NewReloadingServerTLSConfig(certFile, keyFile, clientCAFile string, allowedClientSubjects []string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, fmt.Errorf("server certificate, key and client CA bundle are required for mTLS")
+	}
+	reloader := &certificateReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	baseConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	if len(allowedClientSubjects) > 0 {
+		baseConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyClientSubject(cs, allowedClientSubjects)
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := reloader.get()
+			config := baseConfig.Clone()
+			config.Certificates = []tls.Certificate{*cert}
+			config.ClientCAs = clientCAs
+			return config, nil
+		},
+	}, nil
+}
+
+// certificateReloader holds a server certificate and client CA bundle, and reloads
+// them when the modification time of any of the files changes.
+type certificateReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.Mutex
+	modTimes  []time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (r *certificateReloader) get() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.getModTimes()
+	if err == nil && !slices.Equal(modTimes, r.modTimes) {
+		if err = r.loadLocked(); err == nil {
+			mlog.Always("reloaded server certificate", "certFile", r.certFile, "clientCAFile", r.clientCAFile)
+		}
+	}
+	if err != nil {
+		// keep serving with the last valid certificate, the files may be in the middle of an update
+		mlog.Error("failed to reload server certificate", err, "certFile", r.certFile, "clientCAFile", r.clientCAFile)
+	}
+	return r.cert, r.clientCAs
+}
+
+func (r *certificateReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *certificateReloader) loadLocked() error {
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load server certificate %s and key %s, error: %w", r.certFile, r.keyFile, err)
+	}
+	clientCAs, err := loadCertPool(r.clientCAFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.clientCAs, r.modTimes = &cert, clientCAs, modTimes
+	return nil
+}
+
+func (r *certificateReloader) getModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s, error: %w", file, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// verifyClientSubject returns an error if the verified client certificate common name
+// and DNS names are not in allowedSubjects.
+func verifyClientSubject(cs tls.ConnectionState, allowedSubjects []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("client certificate is required")
+	}
+	leaf := cs.PeerCertificates[0]
+	for _, subject := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+		if subject != "" && slices.Contains(allowedSubjects, subject) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate subject %q is not allowed", leaf.Subject.CommonName)
+}
@@ -0,0 +1,319 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewClientTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "client")
+	invalidCAFile := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidCAFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write invalid CA bundle: %v", err)
+	}
+
+	tests := []struct {
+		desc          string
+		caFile        string
+		certFile      string
+		keyFile       string
+		expectedCerts int
+		expectedError bool
+	}{
+		{
+			desc: "system roots without client certificate",
+		},
+		{
+			desc:   "custom CA bundle",
+			caFile: certFile,
+		},
+		{
+			desc:          "custom CA bundle with client certificate",
+			caFile:        certFile,
+			certFile:      certFile,
+			keyFile:       keyFile,
+			expectedCerts: 1,
+		},
+		{
+			desc:          "missing CA bundle",
+			caFile:        filepath.Join(dir, "missing.pem"),
+			expectedError: true,
+		},
+		{
+			desc:          "invalid CA bundle",
+			caFile:        invalidCAFile,
+			expectedError: true,
+		},
+		{
+			desc:          "client certificate without key",
+			certFile:      certFile,
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tlsConfig, err := NewClientTLSConfig(test.caFile, test.certFile, test.keyFile, "proxy.local")
+			if test.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if tlsConfig.ServerName != "proxy.local" {
+				t.Fatalf("expected server name: proxy.local, got: %s", tlsConfig.ServerName)
+			}
+			if (test.caFile != "") != (tlsConfig.RootCAs != nil) {
+				t.Fatalf("expected root CAs to be set: %v", test.caFile != "")
+			}
+			if len(tlsConfig.Certificates) != test.expectedCerts {
+				t.Fatalf("expected %d client certificates, got: %d", test.expectedCerts, len(tlsConfig.Certificates))
+			}
+		})
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "server")
+
+	tests := []struct {
+		desc               string
+		certFile           string
+		keyFile            string
+		clientCAFile       string
+		expectedClientAuth tls.ClientAuthType
+		expectedError      bool
+	}{
+		{
+			desc:               "server certificate",
+			certFile:           certFile,
+			keyFile:            keyFile,
+			expectedClientAuth: tls.NoClientCert,
+		},
+		{
+			desc:               "server certificate with client CA",
+			certFile:           certFile,
+			keyFile:            keyFile,
+			clientCAFile:       certFile,
+			expectedClientAuth: tls.RequireAndVerifyClientCert,
+		},
+		{
+			desc:          "missing server key",
+			certFile:      certFile,
+			expectedError: true,
+		},
+		{
+			desc:          "missing client CA",
+			certFile:      certFile,
+			keyFile:       keyFile,
+			clientCAFile:  filepath.Join(dir, "missing.pem"),
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tlsConfig, err := NewServerTLSConfig(test.certFile, test.keyFile, test.clientCAFile)
+			if test.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if tlsConfig.ClientAuth != test.expectedClientAuth {
+				t.Fatalf("expected client auth: %v, got: %v", test.expectedClientAuth, tlsConfig.ClientAuth)
+			}
+			if len(tlsConfig.Certificates) != 1 {
+				t.Fatalf("expected 1 server certificate, got: %d", len(tlsConfig.Certificates))
+			}
+		})
+	}
+}
+
+func TestNewReloadingServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile := writeTestCertificate(t, dir, "server")
+	clientCertFile, clientKeyFile := writeTestCertificate(t, dir, "client")
+	otherCertFile, otherKeyFile := writeTestCertificate(t, dir, "other")
+	// the client CA bundle trusts both self-signed client certificates
+	caFile := filepath.Join(dir, "ca.crt")
+	var caData []byte
+	for _, file := range []string{clientCertFile, otherCertFile} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read certificate: %v", err)
+		}
+		caData = append(caData, data...)
+	}
+	if err := os.WriteFile(caFile, caData, 0o600); err != nil {
+		t.Fatalf("failed to write CA bundle: %v", err)
+	}
+
+	if _, err := NewReloadingServerTLSConfig(serverCertFile, serverKeyFile, "", nil); err == nil {
+		t.Fatalf("expected error without client CA bundle, got nil")
+	}
+
+	serverConfig, err := NewReloadingServerTLSConfig(serverCertFile, serverKeyFile, caFile, []string{"client"})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	tests := []struct {
+		desc          string
+		certFile      string
+		keyFile       string
+		expectedError bool
+	}{
+		{
+			desc:     "allowed client subject",
+			certFile: clientCertFile,
+			keyFile:  clientKeyFile,
+		},
+		{
+			desc:          "client subject not allowed",
+			certFile:      otherCertFile,
+			keyFile:       otherKeyFile,
+			expectedError: true,
+		},
+		{
+			desc:          "no client certificate",
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := handshake(t, serverConfig, serverCertFile, test.certFile, test.keyFile)
+			if test.expectedError && err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+			if !test.expectedError && err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+		})
+	}
+
+	t.Run("reload server certificate", func(t *testing.T) {
+		rotatedCertFile, rotatedKeyFile := writeTestCertificate(t, t.TempDir(), "server")
+		for src, dst := range map[string]string{rotatedCertFile: serverCertFile, rotatedKeyFile: serverKeyFile} {
+			data, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatalf("failed to read rotated file: %v", err)
+			}
+			if err := os.WriteFile(dst, data, 0o600); err != nil {
+				t.Fatalf("failed to write rotated file: %v", err)
+			}
+			future := time.Now().Add(time.Minute)
+			if err := os.Chtimes(dst, future, future); err != nil {
+				t.Fatalf("failed to update modification time: %v", err)
+			}
+		}
+
+		if err := handshake(t, serverConfig, rotatedCertFile, clientCertFile, clientKeyFile); err != nil {
+			t.Fatalf("expected rotated certificate to be served, got: %v", err)
+		}
+	})
+}
+
+// handshake connects a client that trusts rootFile to a server using serverConfig.
+// It returns the server side error, or the client side error if the server accepted the connection.
+func handshake(t *testing.T, serverConfig *tls.Config, rootFile, certFile, keyFile string) error {
+	t.Helper()
+
+	clientConfig, err := NewClientTLSConfig(rootFile, certFile, keyFile, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create client tls config: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		server := tls.Server(conn, serverConfig)
+		err = server.Handshake()
+		if err == nil {
+			_, err = server.Write([]byte("x"))
+		}
+		serverErr <- err
+	}()
+
+	client, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		<-serverErr
+		return err
+	}
+	defer client.Close()
+	// the server verifies the client certificate after the client side of the TLS 1.3 handshake completes
+	_, clientErr := client.Read(make([]byte, 1))
+	if err := <-serverErr; err != nil {
+		return err
+	}
+	return clientErr
+}
+
+// writeTestCertificate writes a self-signed certificate and key for localhost to dir.
+func writeTestCertificate(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}